@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrEntryInProgress represents an error where an entry can not be changed as it is being downloaded
+	ErrEntryInProgress = errors.New("cache entry is being downloaded")
+)
+
+// EntryInfo represents the metadata of a cache entry
+type EntryInfo struct {
+	ID         string     `json:"id"`
+	Path       string     `json:"path"`
+	Params     url.Values `json:"params,omitempty"`
+	Status     State      `json:"status"`
+	InitTime   time.Time  `json:"init_time"`
+	LastAccess time.Time  `json:"last_access"`
+	Age        string     `json:"age"`
+	Expired    bool       `json:"expired"`
+	Volume     string     `json:"volume,omitempty"`
+	CachedFile string     `json:"cached_file,omitempty"`
+	Encoding   string     `json:"encoding,omitempty"`
+	Encrypted  bool       `json:"encrypted"`
+	Size       int64      `json:"size"`
+	Hits       int        `json:"hits"`
+}
+
+// EntryFilter represents the entries that are listed or purged
+type EntryFilter struct {
+	// Prefix only matches entries of which the request path starts with the prefix
+	Prefix string
+	// Path only matches entries with this request path
+	Path string
+	// Status only matches entries in this state
+	Status State
+	// MinAge only matches entries that were initialized at least MinAge ago
+	MinAge time.Duration
+	// MaxAge only matches entries that were initialized at most MaxAge ago
+	MaxAge time.Duration
+}
+
+// matches checks if an entry passes the filter
+func (f *EntryFilter) matches(e *Entry) bool {
+	if !strings.HasPrefix(e.Path, f.Prefix) || (f.Path != "" && e.Path != f.Path) {
+		return false
+	}
+	if f.Status != StateInvalid && e.Status != f.Status {
+		return false
+	}
+	age := time.Since(e.InitTime.Time())
+	if f.MinAge > 0 && age < f.MinAge {
+		return false
+	}
+
+	return f.MaxAge <= 0 || age <= f.MaxAge
+}
+
+// VolumeStats represents the usage of a cache volume
+type VolumeStats struct {
+	Dir       string `json:"dir"`
+	Capacity  int64  `json:"capacity"`
+	Used      int64  `json:"used"`
+	Available bool   `json:"available"`
+	Full      bool   `json:"full"`
+}
+
+// MemoryStats represents the usage of the memory tier
+type MemoryStats struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+}
+
+// Stats represents aggregate statistics of the cache
+type Stats struct {
+	Entries     int           `json:"entries"`
+	States      map[State]int `json:"states"`
+	Expired     int           `json:"expired"`
+	CachedSize  int64         `json:"cached_size"`
+	Hits        int           `json:"hits"`
+	PassThrough bool          `json:"pass_through"`
+	Offline     bool          `json:"offline"`
+	Volumes     []VolumeStats `json:"volumes"`
+	Memory      *MemoryStats  `json:"memory,omitempty"`
+}
+
+// Entries returns the entries that pass the filter, sorted by request path
+func (c *Cache) Entries(f EntryFilter) []*EntryInfo {
+	infos := []*EntryInfo{}
+	for id, e := range c.b.entries() {
+		e.m.Lock()
+		if f.matches(e) {
+			infos = append(infos, c.b.entryInfo(id, e))
+		}
+		e.m.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Path != infos[j].Path {
+			return infos[i].Path < infos[j].Path
+		}
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos
+}
+
+// Entry returns the entry with the provided ID
+func (c *Cache) Entry(id string) (*EntryInfo, error) {
+	e, ok := c.b.getEntry(id)
+	if !ok {
+		return nil, ErrEntryNotFound
+	}
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	return c.b.entryInfo(id, e), nil
+}
+
+// entryInfo returns the metadata of an entry
+// Make sure to execute this when the entry is locked
+func (b *backend) entryInfo(id string, e *Entry) *EntryInfo {
+	return &EntryInfo{
+		ID:         id,
+		Path:       e.Path,
+		Params:     e.Params,
+		Status:     e.Status,
+		InitTime:   e.InitTime.Time(),
+		LastAccess: e.LastAccess.Time(),
+		Age:        time.Since(e.InitTime.Time()).Round(time.Second).String(),
+		Expired:    b.expiration() > 0 && e.expired(b.expiration()),
+		Volume:     e.Volume,
+		CachedFile: e.CachedFile,
+		Encoding:   e.Encoding,
+		Encrypted:  e.Encrypted,
+		Size:       e.Size,
+		Hits:       e.hits,
+	}
+}
+
+// Purge removes the entry with the provided ID and deletes its cache file
+func (c *Cache) Purge(id string) error {
+	return c.b.purgeEntry(id)
+}
+
+// PurgeEntries removes the entries that pass the filter and deletes their cache files
+// Returns the amount of purged entries
+func (c *Cache) PurgeEntries(f EntryFilter) (int, error) {
+	purged := 0
+	for id, e := range c.b.entries() {
+		e.m.Lock()
+		ok := f.matches(e)
+		e.m.Unlock()
+		if !ok {
+			continue
+		}
+		err := c.b.purgeEntry(id)
+		if err == ErrEntryNotFound {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// purgeEntry drops an entry and deletes its cache file
+// The cache file of an entry that is being downloaded is deleted by the next cache dir cleanup
+func (b *backend) purgeEntry(id string) error {
+	e, ok := b.getEntry(id)
+	if !ok {
+		return ErrEntryNotFound
+	}
+	if v := b.findVolume(e.Volume); v != nil {
+		b.evictEntry(id, e, v)
+	}
+
+	return b.dropEntry(id)
+}
+
+// Refresh marks the entry with the provided ID to be downloaded again on its next request
+func (c *Cache) Refresh(id string) error {
+	e, ok := c.b.getEntry(id)
+	if !ok {
+		return ErrEntryNotFound
+	}
+	state, err := c.b.getEntryState(id)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case StateInProgress:
+		return ErrEntryInProgress
+	case StateCached:
+		e.markRefresh()
+		if v := c.b.findVolume(e.Volume); v != nil && c.b.evictEntry(id, e, v) {
+			c.b.m.Lock()
+			defer c.b.m.Unlock()
+			return c.b.save()
+		}
+	}
+
+	return c.b.setEntryState(id, StateInit)
+}
+
+// Stats returns aggregate statistics of the cache
+func (c *Cache) Stats() *Stats {
+	s := &Stats{
+		States:      map[State]int{},
+		PassThrough: c.b.isPassThrough(),
+		Offline:     c.b.isOffline(),
+		Volumes:     []VolumeStats{},
+	}
+	for _, e := range c.b.entries() {
+		e.m.Lock()
+		s.Entries++
+		s.States[e.Status]++
+		s.Hits += e.hits
+		if e.Status == StateCached {
+			s.CachedSize += e.Size
+			if c.b.expiration() > 0 && e.expired(c.b.expiration()) {
+				s.Expired++
+			}
+		}
+		e.m.Unlock()
+	}
+	for _, v := range c.b.volumes {
+		v.m.Lock()
+		s.Volumes = append(s.Volumes, VolumeStats{
+			Dir:       v.Dir,
+			Capacity:  v.Capacity,
+			Used:      v.used,
+			Available: v.available,
+			Full:      v.full,
+		})
+		v.m.Unlock()
+	}
+	if c.b.mem != nil {
+		entries, size := c.b.mem.stats()
+		s.Memory = &MemoryStats{
+			Entries: entries,
+			Size:    size,
+		}
+	}
+
+	return s
+}
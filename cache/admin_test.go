@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin(t *testing.T) {
+	assert := assert.New(t)
+	nosave = false
+	_, b, clean := newTestCache(t, nil)
+	defer clean()
+	c := &Cache{b: b}
+	foo := addTestEntry(t, b, "/foo/a", []byte("foo"), time.Now())
+	addTestEntry(t, b, "/foo/b", []byte("foobar"), time.Now().Add(-2*time.Hour))
+	bar := addTestEntry(t, b, "/bar", []byte("bar"), time.Now())
+
+	assert.Len(c.Entries(EntryFilter{}), 3)
+	entries := c.Entries(EntryFilter{Prefix: "/foo/", MaxAge: time.Hour})
+	assert.Len(entries, 1)
+	assert.Equal(foo, entries[0].ID)
+	assert.Len(c.Entries(EntryFilter{MinAge: time.Hour}), 1)
+	assert.Len(c.Entries(EntryFilter{Status: StateInit}), 0)
+
+	e, err := c.Entry(bar)
+	assert.NoError(err)
+	assert.Equal("/bar", e.Path)
+	_, err = c.Entry("baz")
+	assert.Equal(ErrEntryNotFound, err)
+
+	stats := c.Stats()
+	assert.Equal(3, stats.Entries)
+	assert.Equal(3, stats.States[StateCached])
+	assert.Equal(int64(12), stats.CachedSize)
+
+	file := b.data[bar].CachedFile
+	assert.NoError(c.Refresh(bar))
+	assert.Equal(StateInit, b.data[bar].Status)
+	assert.False(fileExists(file))
+
+	n, err := c.PurgeEntries(EntryFilter{Prefix: "/foo/"})
+	assert.NoError(err)
+	assert.Equal(2, n)
+	assert.Len(b.data, 1)
+	assert.NoError(c.Purge(bar))
+	assert.Empty(b.data)
+}
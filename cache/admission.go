@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// errNotAdmitted represents a body that does not qualify to be cached
+	errNotAdmitted = errors.New("body is not admitted to the cache")
+)
+
+// admitSize checks if a body of the provided size qualifies to be cached
+func (b *backend) admitSize(size int64) bool {
+	if size < b.minSize {
+		return false
+	}
+	return b.maxSize <= 0 || size <= b.maxSize
+}
+
+// sizeLimitReader calls exceeded once more than max bytes are read from it
+type sizeLimitReader struct {
+	io.ReadCloser
+	read     int64
+	max      int64
+	exceeded func()
+}
+
+// Read implements io.Reader
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.max > 0 && r.read <= r.max && r.read+int64(n) > r.max {
+		r.exceeded()
+	}
+	r.read += int64(n)
+
+	return n, err
+}
+
+// passResponse writes a proxy target response to the response writer without caching it
+// Returns the amount of bytes read from the proxy target
+func passResponse(res http.ResponseWriter, req *http.Request, targetResp *http.Response) (int64, error) {
+	defer targetResp.Body.Close()
+	for name, values := range targetResp.Header {
+		for _, v := range values {
+			res.Header().Add(name, v)
+		}
+	}
+	SetBypassHeaders(res, req)
+	res.WriteHeader(targetResp.StatusCode)
+
+	n, err := io.Copy(res, targetResp.Body)
+	if err != nil {
+		return n, errors.Wrap(err, "failed to copy proxy body")
+	}
+
+	return n, nil
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmitSize(t *testing.T) {
+	assert := assert.New(t)
+	b := &backend{}
+	assert.True(b.admitSize(0))
+	assert.True(b.admitSize(1 << 40))
+
+	b.minSize = 10
+	b.maxSize = 100
+	assert.False(b.admitSize(9))
+	assert.True(b.admitSize(10))
+	assert.True(b.admitSize(100))
+	assert.False(b.admitSize(101))
+}
+
+func TestSizeLimitReader(t *testing.T) {
+	assert := assert.New(t)
+	exceeded := 0
+	r := &sizeLimitReader{
+		ReadCloser: ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 100))),
+		max:        10,
+		exceeded: func() {
+			exceeded++
+		},
+	}
+	buf := make([]byte, 4)
+	for i := 0; i < 2; i++ {
+		r.Read(buf)
+	}
+	assert.Equal(0, exceeded)
+
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Len(data, 92)
+	assert.Equal(1, exceeded)
+}
+
+func TestPassThroughBuffer(t *testing.T) {
+	assert := assert.New(t)
+	resp, err := newResponse(nil, nil, http.StatusOK)
+	assert.NoError(err)
+	r := resp.body.newReader()
+	resp.body.setPassThrough()
+
+	chunk := bytes.Repeat([]byte("a"), 64<<10)
+	total := 200 * len(chunk)
+	go func() {
+		for i := 0; i < 200; i++ {
+			resp.body.Write(chunk)
+		}
+		resp.body.MarkWriteCompleted(nil)
+	}()
+	read := 0
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		read += n
+		resp.body.m.Lock()
+		buffered := len(resp.body.body)
+		resp.body.m.Unlock()
+		// the writer waits for the reader instead of buffering the whole body
+		assert.True(buffered <= passThroughWindow+len(chunk), "buffered %d bytes", buffered)
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(total, read)
+	assert.NoError(r.Close())
+
+	// writing stops once no reader is left
+	_, err = resp.body.Write(chunk)
+	assert.Error(err)
+	resp, err = newResponse(nil, nil, http.StatusOK)
+	assert.NoError(err)
+	resp.body.newReader().Close()
+	resp.body.setPassThrough()
+	_, err = resp.body.Write(chunk)
+	assert.Equal(errNotAdmitted, err)
+}
+
+func TestMaxSizeStreamsUncachedBody(t *testing.T) {
+	assert := assert.New(t)
+	body := strings.Repeat("a", 1<<20)
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		// no content length, the size is only known while downloading
+		res.(http.Flusher).Flush()
+		res.Write([]byte(body))
+	}))
+	defer target.Close()
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	cache, err := New(&Config{
+		BackendFile: path.Join(dir, "backend.data"),
+		CacheDir:    path.Join(dir, "cache"),
+		ProxyTarget: target.URL,
+		MaxSize:     1 << 10,
+	})
+	assert.NoError(err)
+
+	res := httptest.NewRecorder()
+	err = cache.CopyFromCache(res, httptest.NewRequest("GET", "/foo", nil))
+	assert.NoError(err)
+	assert.Equal(body, res.Body.String())
+	assert.Eventually(func() bool {
+		return cache.Stats().States[StateNoCache] == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(cache.Close(context.Background()))
+}
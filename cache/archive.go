@@ -0,0 +1,290 @@
+package cache
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Archives are tar files that start with a metadata file with the exported entries,
+// followed by the stored (compressed but not encrypted) body of every entry in the blobs directory
+const (
+	archiveVersion      = 1
+	archiveMetadataFile = "metadata.json"
+	archiveBlobDir      = "blobs"
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// ExportFilter represents the entries that are included in an export
+type ExportFilter struct {
+	// Prefix only includes entries of which the request path starts with the prefix
+	Prefix string
+	// MaxAge only includes entries that were cached less than MaxAge ago (0 includes all entries)
+	MaxAge time.Duration
+}
+
+// includes checks if an entry passes the filter
+func (f ExportFilter) includes(e *Entry) bool {
+	if !strings.HasPrefix(e.Path, f.Prefix) {
+		return false
+	}
+	return f.MaxAge <= 0 || time.Since(e.InitTime.Time()) <= f.MaxAge
+}
+
+type archiveMetadata struct {
+	Version int               `json:"version"`
+	Entries map[string]*Entry `json:"entries"`
+}
+
+// Export writes the cached entries of the cache that pass the filter, with their bodies, to w as a tar archive
+// The archive is compressed with zstd if compress is set
+// Returns the amount of exported entries
+func Export(c *Config, w io.Writer, filter ExportFilter, compress bool) (int, error) {
+	b, err := openBackend(c)
+	if err != nil {
+		return 0, err
+	}
+
+	metadata := &archiveMetadata{
+		Version: archiveVersion,
+		Entries: map[string]*Entry{},
+	}
+	exported := map[string]*Entry{}
+	for id, e := range b.entries() {
+		if e.Status != StateCached || !filter.includes(e) || !fileExists(e.CachedFile) {
+			continue
+		}
+		exported[id] = e
+		metadata.Entries[id] = &Entry{
+			Path:       e.Path,
+			Params:     e.Params,
+			InitTime:   e.InitTime,
+			LastAccess: e.LastAccess,
+			Status:     StateCached,
+			CachedFile: path.Join(archiveBlobDir, id+".blob"),
+			Encoding:   e.Encoding,
+			Size:       e.Size,
+		}
+	}
+	data, err := json.MarshalIndent(metadata, "", "\t")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to marshal archive metadata")
+	}
+
+	var enc *zstd.Encoder
+	if compress {
+		enc, err = zstd.NewWriter(w)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to create zstd writer")
+		}
+		defer func() {
+			// only releases the encoder if the archive failed, otherwise it is closed already
+			if enc != nil {
+				enc.Close()
+			}
+		}()
+		w = enc
+	}
+	tw := tar.NewWriter(w)
+	err = tw.WriteHeader(&tar.Header{
+		Name:    archiveMetadataFile,
+		Mode:    int64(filePerm),
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to write archive metadata")
+	}
+
+	for id, e := range exported {
+		err = b.exportCacheFile(tw, e, metadata.Entries[id].CachedFile)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to export entry %s", id)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to close archive")
+	}
+	if enc != nil {
+		// the end of the compressed archive is only written when the encoder is closed
+		err = enc.Close()
+		enc = nil
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to compress archive")
+		}
+	}
+
+	return len(exported), nil
+}
+
+// exportCacheFile writes the cache file of an entry to the archive
+func (b *backend) exportCacheFile(tw *tar.Writer, e *Entry, name string) error {
+	body, closer, err := b.openCacheFile(e)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	size, err := body.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = body.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    int64(filePerm),
+		Size:    size,
+		ModTime: e.InitTime.Time(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, body)
+
+	return err
+}
+
+// Import merges the entries of an archive written by Export into the cache
+// When an entry for the same request already exists, it is only replaced if the imported entry is newer
+// Imported bodies are stored on the cache volumes according to the placement policy
+// Returns the amount of imported entries
+func Import(c *Config, r io.Reader) (int, error) {
+	b, err := openBackend(c)
+	if err != nil {
+		return 0, err
+	}
+	err = b.pruneEntries()
+	if err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	r = br
+	if bytes.Equal(magic, zstdMagic) {
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to create zstd reader")
+		}
+		defer dec.Close()
+		r = dec
+	}
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read archive")
+	}
+	if hdr.Name != archiveMetadataFile {
+		return 0, errors.Errorf("archive should start with %s", archiveMetadataFile)
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read archive metadata")
+	}
+	metadata := &archiveMetadata{}
+	err = json.Unmarshal(data, metadata)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse archive metadata")
+	}
+	if metadata.Version > archiveVersion {
+		return 0, errors.Errorf("archive version %d is not supported", metadata.Version)
+	}
+	byFile := map[string]*Entry{}
+	for _, e := range metadata.Entries {
+		byFile[e.CachedFile] = e
+	}
+
+	imported := 0
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, errors.Wrap(err, "failed to read archive")
+		}
+		e, ok := byFile[hdr.Name]
+		if !ok {
+			log.Warnf("Skipping unknown file %s in archive", hdr.Name)
+			continue
+		}
+		ok, err = b.importEntry(e, tr)
+		if err != nil {
+			return imported, errors.Wrapf(err, "failed to import %s", e.Path)
+		}
+		if ok {
+			imported++
+		}
+	}
+
+	b.m.Lock()
+	err = b.save()
+	b.m.Unlock()
+
+	return imported, err
+}
+
+// importEntry adds an entry of an archive to the cache with the body read from r
+// Returns false if the entry was not imported because the cache has a newer entry for the same request
+func (b *backend) importEntry(imported *Entry, r io.Reader) (bool, error) {
+	id, existing := b.findEntry(imported.Path, imported.Params)
+	if existing != nil && existing.Status == StateCached && !existing.InitTime.Time().Before(imported.InitTime.Time()) {
+		log.Debugf("Skipping %s, the cache has a newer entry", imported.Path)
+		return false, nil
+	}
+
+	v, err := b.pickVolume(imported.Path + "?" + imported.Params.Encode())
+	if err != nil {
+		return false, err
+	}
+	if id == "" {
+		b.m.Lock()
+		id = b.generateID()
+		b.m.Unlock()
+	}
+	e := newEntry(imported.Path, imported.Params)
+	e.Status = StateCached
+	e.InitTime = imported.InitTime
+	e.LastAccess = imported.LastAccess
+	e.Encoding = imported.Encoding
+	e.Size = imported.Size
+	e.Volume = v.Dir
+	e.CachedFile = v.generateCacheFileName(id)
+	err = b.storeCacheFile(e, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// the cache file of a replaced entry is deleted by the next cache dir cleanup
+	b.m.Lock()
+	b.data[id] = e
+	b.m.Unlock()
+	if b.mem != nil {
+		b.mem.remove(id)
+	}
+	b.filled(e, FillImport, e.Size)
+
+	return true, nil
+}
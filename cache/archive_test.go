@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCache returns the config and backend of a cache in a temporary directory
+func newTestCache(t *testing.T, key []byte) (*Config, *backend, func()) {
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(t, err)
+	c := &Config{
+		BackendFile:   path.Join(dir, "backend.data"),
+		CacheDir:      path.Join(dir, "cache"),
+		EncryptionKey: key,
+	}
+	b, err := openBackend(c)
+	assert.NoError(t, err)
+
+	return c, b, func() { os.RemoveAll(dir) }
+}
+
+// addTestEntry adds a cached entry with the provided body to the backend
+func addTestEntry(t *testing.T, b *backend, reqPath string, body []byte, initTime time.Time) string {
+	id, err := b.addEntry(reqPath, url.Values{})
+	assert.NoError(t, err)
+	e := b.data[id]
+	e.Volume = b.volumes[0].Dir
+	e.CachedFile = b.volumes[0].generateCacheFileName(id)
+	e.InitTime = JSONTime(initTime)
+	e.Encoding = EncodingGzip
+	e.Size = int64(len(body))
+	e.Status = StateCached
+	assert.NoError(t, b.writeCacheFile(e, body))
+	b.m.Lock()
+	assert.NoError(t, b.save())
+	b.m.Unlock()
+
+	return id
+}
+
+func TestExportImport(t *testing.T) {
+	assert := assert.New(t)
+	src, srcBackend, clean := newTestCache(t, bytes.Repeat([]byte{0x42}, 32))
+	defer clean()
+	addTestEntry(t, srcBackend, "/foo/a", []byte("a"), time.Now())
+	addTestEntry(t, srcBackend, "/foo/b", []byte("new b"), time.Now())
+	addTestEntry(t, srcBackend, "/foo/old", []byte("old"), time.Now().Add(-48*time.Hour))
+	addTestEntry(t, srcBackend, "/bar", []byte("bar"), time.Now())
+
+	archive := &bytes.Buffer{}
+	n, err := Export(src, archive, ExportFilter{Prefix: "/foo/", MaxAge: 24 * time.Hour}, true)
+	assert.NoError(err)
+	assert.Equal(2, n)
+	assert.True(bytes.HasPrefix(archive.Bytes(), zstdMagic))
+
+	// the destination cache has another key and an older and a newer entry for the exported paths
+	dst, dstBackend, clean := newTestCache(t, nil)
+	defer clean()
+	bID := addTestEntry(t, dstBackend, "/foo/b", []byte("old b"), time.Now().Add(-time.Hour))
+	addTestEntry(t, dstBackend, "/foo/a", []byte("newer a"), time.Now().Add(time.Hour))
+
+	n, err = Import(dst, archive)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	b, err := openBackend(dst)
+	assert.NoError(err)
+	assert.Len(b.data, 2)
+	for id, e := range b.data {
+		body, err := b.readCacheFile(e)
+		assert.NoError(err)
+		assert.False(e.Encrypted)
+		switch e.Path {
+		case "/foo/a":
+			assert.Equal("newer a", string(body))
+		case "/foo/b":
+			assert.Equal(bID, id)
+			assert.Equal("new b", string(body))
+		default:
+			t.Errorf("unexpected entry %s", e.Path)
+		}
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestExportWriteError(t *testing.T) {
+	assert := assert.New(t)
+	c, b, clean := newTestCache(t, nil)
+	defer clean()
+	addTestEntry(t, b, "/foo", []byte("foo"), time.Now())
+
+	// the compressed archive is only written out when the encoder is closed
+	for _, compress := range []bool{false, true} {
+		_, err := Export(c, failingWriter{}, ExportFilter{}, compress)
+		assert.Error(err, "compress: %v", compress)
+	}
+}
@@ -1,8 +1,11 @@
 package cache
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -20,34 +23,124 @@ var (
 	ErrEntryNotFound = errors.New("cache entry not found")
 )
 
-func newBackend(filePath, cacheDir, proxyURL string, cacheExp, cleanInterval time.Duration) (*backend, error) {
-	if filePath == "" {
-		return nil, errors.New("backend file path is not provided")
+func newBackend(c *Config) (*backend, error) {
+	b, err := openBackend(c)
+	if err != nil {
+		return nil, err
 	}
-	if cacheDir == "" {
-		return nil, errors.New("cache dir not provided")
+	err = b.pruneEntries()
+	if err != nil {
+		return nil, err
 	}
-	if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
-		log.Debugf("Creating cache dir %s", cacheDir)
-		os.Mkdir(cacheDir, dirPerm)
+	if b.shared {
+		log.Info("Sharing the cache with other processes")
 	} else {
-		log.Debugf("Deleting contents of cache dir %s", cacheDir)
-		removeDirContent(cacheDir)
+		// temporary files and cache files in the previous layout can only be left by a previous run
+		// when no other process uses the cache
+		b.removeTempFiles()
+		b.migrateLayout()
+	}
+	b.cleanCacheDir()
+	b.checkDisk()
+
+	// start cleanup go routine
+	go b.cleanup(b.quit)
+	go b.watchDisk(b.quit)
+
+	return b, nil
+}
+
+// openBackend returns a backend with the entries of the backend file loaded
+func openBackend(c *Config) (*backend, error) {
+	return loadBackend(c, false)
+}
+
+// openExclusiveBackend returns a backend with the entries of the backend file loaded
+// that holds the cache and the backend file for this process alone until it is released
+// Cache volume directories that do not exist are not created
+// Returns ErrCacheInUse if another process uses the cache
+func openExclusiveBackend(c *Config) (*backend, error) {
+	return loadBackend(c, true)
+}
+
+func loadBackend(c *Config, exclusive bool) (*backend, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	vols := c.Volumes
+	if len(vols) == 0 {
+		vols = []*Volume{{Dir: c.CacheDir}}
+	}
+	volumes, err := newVolumes(vols)
+	if err != nil {
+		return nil, err
+	}
+	lowWatermark := c.LowWatermark
+	if lowWatermark <= 0 || lowWatermark > c.HighWatermark {
+		lowWatermark = c.HighWatermark
+	}
+
+	var crypt *encryptor
+	if c.EncryptionKey != nil {
+		crypt, err = newEncryptor(c.EncryptionKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to set up encryption")
+		}
 	}
 
 	b := &backend{
-		targetBaseURL:   proxyURL,
-		filePath:        filePath,
-		cacheDir:        cacheDir,
+		targetBaseURL:   c.ProxyTarget,
+		filePath:        c.BackendFile,
+		volumes:         volumes,
+		placement:       c.Placement,
 		data:            make(map[string]*Entry, 0),
-		http:            &http.Client{},
+		http:            NewUpstreamClient(c.Upstream),
+		bodyTimeout:     c.Upstream.BodyIdleTimeout,
 		m:               &sync.Mutex{},
-		cacheExpiration: cacheExp,
-		cleanupInterval: cleanInterval,
+		cacheExpiration: c.CacheExpiration,
+		cleanupInterval: c.CleanupInterval,
+		routes:          c.Routes,
+		crypt:           crypt,
+		mem:             newMemoryTier(c.Memory),
+		sketches:        newFrequencySketches(c.Routes, nil),
+		minSize:         c.MinSize,
+		maxSize:         c.MaxSize,
+		highWatermark:   c.HighWatermark,
+		lowWatermark:    lowWatermark,
+		evictionPolicy:  c.EvictionPolicy,
+		diskM:           &sync.Mutex{},
+		onUpstreamRead:  c.OnUpstreamRead,
+		onOutcome:       c.OnOutcome,
+		onFill:          c.OnFill,
+		quit:            make(chan struct{}),
+	}
+	b.fillCtx, b.cancelFills = context.WithCancel(context.Background())
+
+	for _, v := range b.volumes {
+		v.check(!exclusive)
+	}
+	b.lock, err = openFileLock(c.BackendFile)
+	if err != nil {
+		return nil, err
+	}
+	if exclusive {
+		err = b.lockExclusive()
+		if err != nil {
+			b.lock.close()
+			return nil, err
+		}
+	} else {
+		sole, err := b.registerProcess()
+		if err != nil {
+			return nil, err
+		}
+		b.shared = !sole
+	}
+	err = b.load()
+	if err != nil {
+		return nil, err
 	}
-
-	// start cleanup go routine
-	go b.cleanup(nil)
 
 	return b, nil
 }
@@ -55,43 +148,114 @@ func newBackend(filePath, cacheDir, proxyURL string, cacheExp, cleanInterval tim
 type backend struct {
 	targetBaseURL   string
 	filePath        string
-	cacheDir        string
+	volumes         []*volume
+	placement       string
+	nextVolume      int
 	data            map[string]*Entry
 	m               *sync.Mutex
 	http            *http.Client
+	bodyTimeout     time.Duration // maximum amount of time a body of the proxy target can stall
 	cleanupInterval time.Duration
+	settingsM       sync.RWMutex // held while the settings that can be reconfigured are read or replaced
 	cacheExpiration time.Duration
+	routes          []*Route
+	sketches        map[*Route]*frequencySketch
+	crypt           *encryptor
+	mem             *memoryTier
+	minSize         int64
+	maxSize         int64
+	highWatermark   float64
+	lowWatermark    float64
+	evictionPolicy  string
+	diskM           *sync.Mutex // held while checking disk usage
+	passThrough     bool
+	offline         bool   // requests are only served from the cache
+	backup          []byte // backend file of an older version to back up on the next save
+	backupVersion   int
+	lock            *fileLock
+	shared          bool   // other processes used the cache when it was opened
+	exclusive       func() // releases the cache and backend file locks of an exclusive backend
+	onUpstreamRead  func(route string, n int64)
+	onOutcome       func(route string, outcome Outcome)
+	onFill          func(route string, source FillSource, size int64)
+	synced          map[string]json.RawMessage // entries as they were last read from or written to the backend file
+	syncedInfo      os.FileInfo
+	quit            chan struct{}      // closed to stop the cleanup go routines
+	fills           sync.WaitGroup     // downloads in progress
+	fillCtx         context.Context    // context of the requests to the proxy target of downloads
+	cancelFills     context.CancelFunc // aborts the downloads in progress
 }
 
 func (b *backend) findEntryByRequest(req *http.Request) (string, error) {
+	id, e := b.findEntry(req.URL.Path, req.URL.Query())
+	if e == nil {
+		return "", ErrEntryNotFound
+	}
+
+	return id, nil
+}
+
+// findEntry returns the entry for a request path and params
+// returns nil if not found
+func (b *backend) findEntry(path string, params url.Values) (string, *Entry) {
+	b.m.Lock()
+	defer b.m.Unlock()
 	for entryID, e := range b.data {
-		if e.Path == req.URL.Path {
-			if reflect.DeepEqual(e.Params, req.URL.Query()) {
-				return entryID, nil
+		if e.Path == path {
+			if reflect.DeepEqual(e.Params, params) {
+				return entryID, e
 			}
 		}
 	}
 
-	return "", ErrEntryNotFound
+	return "", nil
 }
 
 func (b *backend) addEntry(path string, params url.Values) (string, error) {
 	b.m.Lock()
 	defer b.m.Unlock()
 
-	e := &Entry{
-		Path:   path,
-		Params: params,
-		Status: StateInit,
-		m:      &sync.Mutex{},
-		readWg: &sync.WaitGroup{},
-	}
+	e := newEntry(path, params)
 	id := b.generateID()
 	b.data[id] = e
 
 	return id, b.save()
 }
 
+// getEntry returns the entry with the provided ID
+func (b *backend) getEntry(id string) (*Entry, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	e, ok := b.data[id]
+
+	return e, ok
+}
+
+// entries returns a snapshot of the current entries that is safe to iterate
+func (b *backend) entries() map[string]*Entry {
+	b.m.Lock()
+	defer b.m.Unlock()
+	entries := make(map[string]*Entry, len(b.data))
+	for id, e := range b.data {
+		entries[id] = e
+	}
+
+	return entries
+}
+
+// dropEntry removes an entry from the backend
+// Its cache file is deleted by the next cache dir cleanup
+func (b *backend) dropEntry(id string) error {
+	if b.mem != nil {
+		b.mem.remove(id)
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	delete(b.data, id)
+
+	return b.save()
+}
+
 // generateID generates a unique cache entry ID
 // Make sure to execute this when backend is locked
 func (b *backend) generateID() string {
@@ -106,17 +270,16 @@ func (b *backend) generateID() string {
 	}
 }
 
-func (b *backend) setEntryState(id string, state State, lock bool) error {
-	e, ok := b.data[id]
+func (b *backend) setEntryState(id string, state State) error {
+	e, ok := b.getEntry(id)
 	if !ok {
 		return ErrEntryNotFound
 	}
-	if lock {
-		e.m.Lock()
-	}
+	e.m.Lock()
 	e.Status = state
-	if lock {
-		e.m.Unlock()
+	e.m.Unlock()
+	if state != StateCached && b.mem != nil {
+		b.mem.remove(id)
 	}
 	b.m.Lock()
 	err := b.save()
@@ -128,19 +291,20 @@ func (b *backend) setEntryState(id string, state State, lock bool) error {
 	return nil
 }
 
-func (b *backend) setEntryCacheFile(id, file string, lock bool) error {
-	e, ok := b.data[id]
+func (b *backend) setEntryCacheFile(id, file string) error {
+	e, ok := b.getEntry(id)
 	if !ok {
 		return ErrEntryNotFound
 	}
-	if lock {
-		e.m.Lock()
-	}
+	e.m.Lock()
 	e.CachedFile = file
-	if lock {
-		e.m.Unlock()
+	e.m.Unlock()
+	if b.mem != nil {
+		b.mem.remove(id)
 	}
+	b.m.Lock()
 	err := b.save()
+	b.m.Unlock()
 	if err != nil {
 		return errors.Wrap(err, "failed to save new cache file name")
 	}
@@ -149,7 +313,7 @@ func (b *backend) setEntryCacheFile(id, file string, lock bool) error {
 }
 
 func (b *backend) getEntryState(id string) (State, error) {
-	e, ok := b.data[id]
+	e, ok := b.getEntry(id)
 	if !ok {
 		return "", ErrEntryNotFound
 	}
@@ -171,12 +335,26 @@ func (b *backend) proxy(id string, res http.ResponseWriter, req *http.Request) e
 		return b.entryInit(id, res, req)
 	case StateInProgress:
 		log.Debugf("In progress entry %s", id)
-		return b.entryInProgress(id, res)
+		if !b.downloadingLocally(id) {
+			err := b.waitForDownload(req.Context(), id)
+			if err != nil {
+				return err
+			}
+			return b.proxy(id, res, req)
+		}
+		return b.entryInProgress(id, res, req, OutcomeCoalesced)
 	case StateCached:
 		log.Debugf("Cached entry %s", id)
 		return b.entryCached(id, res, req)
 	case StateNoCache:
 		log.Debugf("No cache entry %s", id)
+		e, ok := b.getEntry(id)
+		if ok && e.isExpired(b.expiration()) {
+			// reconsider caching the entry
+			log.Debugf("No cache entry %s has expired", id)
+			b.setEntryState(id, StateInit)
+			return b.entryInit(id, res, req)
+		}
 		return ErrNoCache
 	default:
 		return errors.Errorf("State %s not supported", state)
@@ -184,125 +362,432 @@ func (b *backend) proxy(id string, res http.ResponseWriter, req *http.Request) e
 }
 
 func (b *backend) entryInit(id string, res http.ResponseWriter, req *http.Request) error {
-	e, ok := b.data[id]
+	e, ok := b.getEntry(id)
 	if !ok {
 		return ErrEntryNotFound
 	}
+	// concurrent requests wait for the request that initializes the entry,
+	// its fields are only locked briefly so the backend file can be saved in the meantime
+	e.init.Lock()
 	e.m.Lock()
+	state := e.Status
+	e.m.Unlock()
 
-	if e.Status == StateInProgress {
+	if state == StateInProgress {
 		log.Debugf("entry %s seem to already be in progress", id)
-		e.m.Unlock()
-		return b.entryInProgress(id, res)
-	} else if e.Status != StateInit {
-		e.m.Unlock()
-		return errors.Errorf("Entry in unexpected state: %s, expected init", e.Status)
+		e.init.Unlock()
+		return b.entryInProgress(id, res, req, OutcomeCoalesced)
+	} else if state == StateCached || state == StateNoCache {
+		log.Debugf("entry %s was finished by another request", id)
+		e.init.Unlock()
+		return b.proxy(id, res, req)
+	} else if state != StateInit {
+		e.init.Unlock()
+		return errors.Errorf("Entry in unexpected state: %s, expected init", state)
+	}
+
+	// only one process downloads a key at a time
+	key := e.key()
+	err := b.lockKey(req.Context(), key)
+	if err != nil {
+		e.init.Unlock()
+		return errors.Wrap(err, "failed to wait for download")
+	}
+	e.m.Lock()
+	e.downloading = true
+	e.m.Unlock()
+	started := false
+	defer func() {
+		if !started {
+			e.m.Lock()
+			e.downloading = false
+			e.m.Unlock()
+			b.unlockKey(key)
+		}
+	}()
+	// another process might have downloaded the key in the meantime
+	err = b.sync()
+	if err != nil {
+		log.Errorf("Failed to sync backend file: %s", err)
+	}
+	if cachedID, ok := b.findCached(id, e); ok {
+		log.Debugf("Entry %s was cached as %s by another process", id, cachedID)
+		e.init.Unlock()
+		err = b.dropEntry(id)
+		if err != nil {
+			log.Error(err)
+		}
+		return b.proxy(cachedID, res, req)
 	}
 
 	tURL, err := b.getProxyURL(e.Path)
 	if err != nil {
-		e.m.Unlock()
+		e.init.Unlock()
 		return errors.Wrap(err, "failed to get target proxy URL")
 	}
-	targetReq, err := http.NewRequest("GET", tURL, req.Body)
+	vol, err := b.pickVolume(e.Path + "?" + req.URL.RawQuery)
+	if err == ErrNoVolume {
+		e.init.Unlock()
+		log.Debugf("Not caching entry %s: %s", id, err)
+		return ErrNoCache
+	}
+	if err != nil {
+		e.init.Unlock()
+		return err
+	}
+	// the download continues when the client of the request is gone
+	targetReq, err := http.NewRequestWithContext(b.fillCtx, "GET", tURL, req.Body)
 	targetReq.URL.RawQuery = req.URL.RawQuery
 	for name, values := range req.Header {
 		for _, v := range values {
 			targetReq.Header.Add(name, v)
 		}
 	}
+	setUpstream(req, targetReq.URL.Host)
 	targetResp, err := b.http.Do(targetReq)
 	if err != nil {
+		e.init.Unlock()
+		return errors.Wrap(ErrTargetUnreachable, err.Error())
+	}
+	// a stalled download is aborted and the entry is downloaded again on its next request
+	targetResp.Body = NewStallReader(targetResp.Body, b.bodyTimeout)
+	if targetResp.ContentLength >= 0 && !b.admitSize(targetResp.ContentLength) {
+		log.Debugf("Not caching entry %s of %d bytes", id, targetResp.ContentLength)
+		e.m.Lock()
+		e.InitTime = JSONTime(time.Now())
 		e.m.Unlock()
-		return errors.Wrap(err, "target request failed")
+		err = b.setEntryState(id, StateNoCache)
+		e.init.Unlock()
+		if err != nil {
+			log.Error(err)
+		}
+		b.setOutcome(req, OutcomeBypass)
+		n, err := passResponse(res, req, targetResp)
+		b.upstreamRead(e.Path, n)
+		return err
 	}
-	e.resp, err = newResponse(targetResp.Header, targetResp.Body, targetResp.StatusCode)
+	resp, err := newResponse(targetResp.Header, targetResp.Body, targetResp.StatusCode)
 	if err != nil {
-		e.m.Unlock()
+		e.init.Unlock()
 		return errors.Wrap(err, "failed to create cached response")
 	}
-	cacheFile := b.generateCacheFileName(id)
-	err = b.setEntryCacheFile(id, cacheFile, false)
+	v, err := b.newEntryVerifier(e.Path)
 	if err != nil {
-		e.m.Unlock()
+		e.init.Unlock()
+		targetResp.Body.Close()
 		return err
 	}
+	e.m.Lock()
+	e.resp = resp
+	e.Volume = vol.Dir
+	e.CachedFile = vol.generateCacheFileName(id)
 	e.InitTime = JSONTime(time.Now())
-	err = b.setEntryState(id, StateInProgress, false)
+	e.Encoding = compressionFor(b.route(e.Path), e.Path, targetResp.Header)
+	e.Size = 0
+	e.hits = 0
+	e.m.Unlock()
+	err = b.setEntryState(id, StateInProgress)
 	if err != nil {
-		e.m.Unlock()
+		e.init.Unlock()
 		return err
 	}
 
-	go b.startCaching(id, e, targetResp.Body)
+	started = true
+	// the reader is taken before the download starts so this request streams the buffer of this download
+	r := resp.body.newReader()
+	b.fills.Add(1)
+	go b.startCaching(id, e, targetResp.Body, v)
 
 	log.Debugf("Entry %s is initialized", id)
+	e.init.Unlock()
+
+	return b.streamResponse(id, e, resp, r, res, req, OutcomeMiss)
+}
+
+// findCached returns the ID of another entry for the same request as e that is cached and not expired
+func (b *backend) findCached(id string, e *Entry) (string, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for otherID, other := range b.data {
+		if otherID == id || other.Path != e.Path || !reflect.DeepEqual(other.Params, e.Params) {
+			continue
+		}
+		other.m.Lock()
+		cached := other.Status == StateCached && (b.expiration() <= 0 || !other.expired(b.expiration()))
+		other.m.Unlock()
+		if cached {
+			return otherID, true
+		}
+	}
+
+	return "", false
+}
+
+// downloadingLocally checks if an entry is downloaded by this process
+func (b *backend) downloadingLocally(id string) bool {
+	e, ok := b.getEntry(id)
+	if !ok {
+		return false
+	}
+
+	return e.isDownloading()
+}
+
+// waitForDownload waits until another process finished downloading an entry and loads the result
+// An entry that is in progress while no process downloads it is reset to be downloaded again
+func (b *backend) waitForDownload(ctx context.Context, id string) error {
+	e, ok := b.getEntry(id)
+	if !ok {
+		return ErrEntryNotFound
+	}
+	log.Debugf("Waiting for entry %s to be downloaded by another process", id)
+	key := e.key()
+	err := b.lockKey(ctx, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to wait for download")
+	}
+	defer b.unlockKey(key)
+	err = b.sync()
+	if err != nil {
+		return err
+	}
+
+	e, ok = b.getEntry(id)
+	if !ok {
+		// dropped by the other process
+		return ErrNoCache
+	}
+	e.m.Lock()
+	stale := e.Status == StateInProgress && !e.downloading
 	e.m.Unlock()
+	if stale {
+		log.Debugf("Entry %s was not finished by another process", id)
+		return b.setEntryState(id, StateInit)
+	}
+
+	return nil
+}
+
+// newEntryVerifier returns a checksum verifier for the request path if its route requires one
+// returns nil if the body does not need to be verified
+func (b *backend) newEntryVerifier(reqPath string) (*verifier, error) {
+	r := b.route(reqPath)
+	if r == nil || r.Checksum == nil || r.Checksum.isChecksumFile(reqPath) {
+		return nil, nil
+	}
+	v, err := newVerifier(r.Checksum, reqPath, b.fetch)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create checksum verifier for route %s", r.Name)
+	}
 
-	return b.entryInProgress(id, res)
+	return v, nil
 }
 
-func (b *backend) generateCacheFileName(id string) string {
-	filename := fmt.Sprintf("%s_%s.blob", id, generateID(10))
-	return path.Join(b.cacheDir, filename)
+// fetch returns the body of a request path on the proxy target
+func (b *backend) fetch(reqPath string) ([]byte, error) {
+	tURL, err := b.getProxyURL(reqPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get target proxy URL")
+	}
+	resp, err := b.http.Get(tURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "target request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("target responded with status %d for %s", resp.StatusCode, reqPath)
+	}
+
+	return ioutil.ReadAll(resp.Body)
 }
 
-func (b *backend) startCaching(entryID string, e *Entry, body io.ReadCloser) {
-	err := e.resp.cacheBody(body, e.CachedFile, e.readWg)
+func (b *backend) startCaching(entryID string, e *Entry, body io.ReadCloser, v *verifier) {
+	defer b.fills.Done()
+	e.m.Lock()
+	resp := e.resp
+	e.m.Unlock()
+	defer func() {
+		e.m.Lock()
+		e.downloading = false
+		if e.resp == resp {
+			// the entry left the in progress state, new requests no longer stream the buffer
+			e.resp = nil
+		}
+		e.m.Unlock()
+		b.unlockKey(e.key())
+	}()
+	limited := &sizeLimitReader{
+		ReadCloser: body,
+		max:        b.maxSize,
+		exceeded: func() {
+			// stop new requests from waiting on the download, current readers keep streaming
+			log.Debugf("Entry %s exceeds the maximum size, not caching", entryID)
+			b.setEntryState(entryID, StateNoCache)
+			// no reader attaches after the state changed, stop buffering what they have read
+			resp.body.setPassThrough()
+		},
+	}
+	size, err := resp.cacheBody(limited, v, func(data []byte) error {
+		if !b.admitSize(int64(len(data))) {
+			return errNotAdmitted
+		}
+		return b.writeCacheFile(e, data)
+	})
 	log.Debugf("Entry %s downloaded", entryID)
+	b.upstreamRead(e.Path, limited.read)
+	if errors.Cause(err) == errNotAdmitted {
+		log.Debugf("Entry %s of %d bytes is not cached", entryID, size)
+		b.setEntryState(entryID, StateNoCache)
+		return
+	}
 	if err != nil {
 		log.Errorf(err.Error())
-		b.setEntryState(entryID, StateInit, true)
+		b.setEntryState(entryID, StateInit)
+		// the disk might be full
+		b.checkDisk()
 		return
 	}
 
-	b.setEntryState(entryID, StateCached, true)
+	source := FillDownload
+	e.m.Lock()
+	e.Size = size
+	e.LastAccess = JSONTime(time.Now())
+	if e.refresh {
+		source = FillRefresh
+		e.refresh = false
+	}
+	e.m.Unlock()
+	b.setEntryState(entryID, StateCached)
+	b.filled(e, source, size)
 }
 
-func (b *backend) entryInProgress(id string, res http.ResponseWriter) error {
-	e, ok := b.data[id]
+// entryInProgress streams the response of an entry that is being downloaded to the response writer
+func (b *backend) entryInProgress(id string, res http.ResponseWriter, req *http.Request, outcome Outcome) error {
+	e, ok := b.getEntry(id)
 	if !ok {
 		return ErrEntryNotFound
 	}
 
-	for name, values := range e.resp.headers {
+	e.m.Lock()
+	if e.Status != StateInProgress || e.resp == nil {
+		e.m.Unlock()
+		// the download finished in the meantime
+		if b.isOffline() {
+			return b.copyOffline(res, req)
+		}
+		return b.proxy(id, res, req)
+	}
+	resp := e.resp
+	r := resp.body.newReader()
+	e.m.Unlock()
+
+	return b.streamResponse(id, e, resp, r, res, req, outcome)
+}
+
+// streamResponse writes a response that is being downloaded to the response writer
+// The reader is closed when the response is written
+func (b *backend) streamResponse(id string, e *Entry, resp *response, r *responseBodyReader, res http.ResponseWriter, req *http.Request, outcome Outcome) error {
+	defer r.Close()
+	b.setOutcome(req, outcome)
+	for name, values := range resp.headers {
 		for _, v := range values {
 			res.Header().Add(name, v)
 		}
 	}
-	res.WriteHeader(e.resp.responseCode)
+	b.setCacheHeaders(res, req, outcome, id, e)
+	res.WriteHeader(resp.responseCode)
 
-	e.readWg.Add(1)
-	_, err := io.Copy(res, e.resp.getReader())
+	_, err := io.Copy(res, r)
 	if err != nil {
 		return errors.Wrap(err, "failed to get reader from buffer")
 	}
-	e.readWg.Done()
 
 	return nil
 }
 
 // entryCached writes the contents of the cached file to the response writer
 func (b *backend) entryCached(id string, res http.ResponseWriter, req *http.Request) error {
-	e, ok := b.data[id]
+	e, ok := b.getEntry(id)
 	if !ok {
 		return ErrEntryNotFound
 	}
 
 	// check if cache entry is already expired
-	if e.expired(b.cacheExpiration) {
+	if e.isExpired(b.expiration()) {
 		log.Debugf("Entry %s has expired", id)
 		// if so set to init state and recache
-		b.setEntryState(id, StateInit, true)
+		e.markRefresh()
+		b.setEntryState(id, StateInit)
 		return b.entryInit(id, res, req)
 	}
 
-	cacheFile, err := os.Open(e.CachedFile)
+	return b.serveCached(id, e, res, req, OutcomeHit)
+}
+
+// serveCached writes the cached file of an entry to the response writer
+func (b *backend) serveCached(id string, e *Entry, res http.ResponseWriter, req *http.Request, outcome Outcome) error {
+	e.m.Lock()
+	e.hits++
+	hits := e.hits
+	e.LastAccess = JSONTime(time.Now())
+	// the entry can be downloaded again while its cached file is served
+	cached := *e
+	e.m.Unlock()
+
+	if b.mem != nil {
+		if data, ok := b.mem.get(id, cached.CachedFile); ok {
+			b.setOutcome(req, outcome)
+			b.setCacheHeaders(res, req, outcome, id, &cached)
+			http.ServeContent(res, req, "", time.Time{}, bytes.NewReader(data))
+			return nil
+		}
+		if b.mem.admissible(cached.Size, hits) {
+			data, err := b.readCacheFile(&cached)
+			if os.IsNotExist(err) {
+				return b.cacheFileMissing(id, e, cached.CachedFile, res, req)
+			}
+			if err != nil {
+				return errors.Wrap(err, "failed to read cached file")
+			}
+			b.mem.add(id, cached.CachedFile, data)
+			b.setOutcome(req, outcome)
+			b.setCacheHeaders(res, req, outcome, id, &cached)
+			http.ServeContent(res, req, "", time.Time{}, bytes.NewReader(data))
+			return nil
+		}
+	}
+
+	body, closer, err := b.openCacheFile(&cached)
+	if os.IsNotExist(err) {
+		return b.cacheFileMissing(id, e, cached.CachedFile, res, req)
+	}
 	if err != nil {
 		return errors.Wrap(err, "failed to open cached file")
 	}
-	defer cacheFile.Close()
-	_, err = io.Copy(res, cacheFile)
+	defer closer.Close()
+	b.setOutcome(req, outcome)
+	b.setCacheHeaders(res, req, outcome, id, &cached)
+
+	if cached.Encoding == "" {
+		// supports range requests
+		http.ServeContent(res, req, "", time.Time{}, body)
+		return nil
+	}
+
+	var r io.Reader = body
+	if acceptsEncoding(req, cached.Encoding) {
+		// pass the compressed file through as is
+		res.Header().Set("Content-Encoding", cached.Encoding)
+		res.Header().Add("Vary", "Accept-Encoding")
+	} else {
+		dec, err := newDecoder(body, cached.Encoding)
+		if err != nil {
+			return errors.Wrap(err, "failed to decompress cached file")
+		}
+		defer dec.Close()
+		r = dec
+	}
+	_, err = io.Copy(res, r)
 	if err != nil {
 		return errors.Wrap(err, "failed to read from cache file")
 	}
@@ -310,6 +795,35 @@ func (b *backend) entryCached(id string, res http.ResponseWriter, req *http.Requ
 	return nil
 }
 
+// cacheFileMissing initialises an entry of which the cached file is gone again, eg: because its volume was removed,
+// and serves the request as a miss
+func (b *backend) cacheFileMissing(id string, e *Entry, file string, res http.ResponseWriter, req *http.Request) error {
+	log.Warnf("Cached file %s of entry %s is missing, caching it again", file, id)
+	if b.mem != nil {
+		b.mem.remove(id)
+	}
+	e.m.Lock()
+	// the entry might have been cached again in the meantime
+	gone := e.Status == StateCached && e.CachedFile == file
+	e.m.Unlock()
+	if gone {
+		err := b.setEntryCacheFile(id, "")
+		if err != nil {
+			return err
+		}
+		err = b.setEntryState(id, StateInit)
+		if err != nil {
+			return err
+		}
+	}
+	if b.isOffline() {
+		b.writeOfflineMiss(res, req, id)
+		return nil
+	}
+
+	return b.proxy(id, res, req)
+}
+
 func (b *backend) getProxyURL(reqPath string) (string, error) {
 	u, err := url.Parse(b.targetBaseURL)
 	if err != nil {
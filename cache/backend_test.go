@@ -1,9 +1,17 @@
 package cache
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -12,16 +20,53 @@ func TestGenerateCacheFileName(t *testing.T) {
 	assert := assert.New(t)
 	entryID := "foobar"
 	cacheDir := "/tmp"
-	b := &backend{
-		cacheDir: cacheDir,
+	v := &volume{
+		Volume: Volume{Dir: cacheDir},
 	}
 
-	result1 := b.generateCacheFileName(entryID)
-	assert.True(strings.HasPrefix(result1, fmt.Sprintf("%s/%s_", cacheDir, entryID)))
+	result1 := v.generateCacheFileName(entryID)
+	name := strings.TrimSuffix(path.Base(result1), ".blob")
+	assert.Equal(fmt.Sprintf("%s/%s/%s/%s.blob", cacheDir, name[0:2], name[2:4], name), result1)
 	assert.True(strings.HasSuffix(result1, ".blob"))
 
-	result2 := b.generateCacheFileName(entryID)
+	result2 := v.generateCacheFileName(entryID)
 	assert.NotEqual(result1, result2)
-	assert.True(strings.HasPrefix(result2, fmt.Sprintf("%s/%s_", cacheDir, entryID)))
+	assert.True(strings.HasPrefix(result2, fmt.Sprintf("%s/", cacheDir)))
 	assert.True(strings.HasSuffix(result1, ".blob"))
 }
+
+func TestConcurrentMisses(t *testing.T) {
+	assert := assert.New(t)
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.URL.Path))
+	}))
+	defer target.Close()
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	cache, err := New(&Config{
+		BackendFile: path.Join(dir, "backend.data"),
+		CacheDir:    path.Join(dir, "cache"),
+		ProxyTarget: target.URL,
+	})
+	assert.NoError(err)
+
+	// small bodies finish downloading while the requests that started them are attaching to them
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 64; i++ {
+		for _, p := range []string{fmt.Sprintf("/distinct/%d", i), "/same"} {
+			wg.Add(1)
+			go func(p string) {
+				defer wg.Done()
+				res := httptest.NewRecorder()
+				assert.NoError(cache.CopyFromCache(res, httptest.NewRequest("GET", p, nil)))
+				assert.Equal(p, res.Body.String())
+			}(p)
+		}
+	}
+	wg.Wait()
+	assert.Eventually(func() bool {
+		return cache.Stats().States[StateCached] == 65
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(cache.Close(context.Background()))
+}
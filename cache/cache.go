@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -12,43 +13,170 @@ var (
 	ErrNoCache = errors.New("Entry is not cached")
 )
 
-// New returns a new Cache instance
-// backendFilePath represents the file on the filesystem where the metadata is stored
-// minSize represents the minimum size of the body to be cached (0 caches everything)
-func New(backendFilePath, cacheDir, proxyURL string, minSize int, cacheExp, cleanInterval time.Duration) (*Cache, error) {
-	b, err := newBackend(backendFilePath, cacheDir, proxyURL, cacheExp, cleanInterval)
+// Config represents a cache configuration
+type Config struct {
+	// BackendFile represents the file on the filesystem where the metadata is stored
+	BackendFile string
+	// CacheDir represents the directory where cached bodies are stored
+	// Only used if no volumes are provided
+	CacheDir string
+	// Volumes represents the directories where cached bodies are stored
+	Volumes []*Volume
+	// Placement represents the policy that picks the volume a cached body is stored in
+	// (round-robin, most-free or hash). Defaults to round-robin
+	Placement string
+	// ProxyTarget represents the base URL of the proxied server
+	ProxyTarget string
+	// MinSize represents the minimum size of the body to be cached (0 caches everything)
+	MinSize int64
+	// MaxSize represents the maximum size of the body to be cached (0 caches everything)
+	MaxSize int64
+	// CacheExpiration represents the amount of time a cache entry is valid
+	CacheExpiration time.Duration
+	// CleanupInterval represents the amount of time in between cache cleanups
+	CleanupInterval time.Duration
+	// Routes represents the caching rules per request path prefix
+	Routes []*Route
+	// EncryptionKey represents the AES key cache files and the backend file are encrypted with
+	// Nothing is encrypted if not provided
+	EncryptionKey []byte
+	// HighWatermark represents the percentage of disk usage of a volume at which entries are evicted (0 disables eviction)
+	HighWatermark float64
+	// LowWatermark represents the percentage of disk usage of a volume entries are evicted to
+	LowWatermark float64
+	// EvictionPolicy represents the order in which entries are evicted (lru or fifo). Defaults to lru
+	EvictionPolicy string
+	// Memory represents the configuration of the in memory tier in front of the cache dir
+	Memory MemoryConfig
+	// Upstream represents the timeouts of the requests to the proxy target
+	Upstream UpstreamConfig
+	// OnUpstreamRead is called with the name of the route and the amount of bytes
+	// every time the cache finished reading a body from the proxy target, eg: to collect metrics
+	OnUpstreamRead func(route string, n int64)
+	// OnOutcome is called with the name of the route and the outcome of every request the cache decided on
+	OnOutcome func(route string, outcome Outcome)
+	// OnFill is called with the name of the route, the source and the size of every entry stored in the cache
+	OnFill func(route string, source FillSource, size int64)
+}
+
+// Validate checks if the config is usable without opening the cache
+func (c *Config) Validate() error {
+	if c.BackendFile == "" {
+		return errors.New("backend file path is not provided")
+	}
+	err := ValidateRoutes(c.Routes)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	for _, v := range c.Volumes {
+		if v.Dir == "" {
+			return errors.New("cache volume has no directory")
+		}
+	}
+	switch c.Placement {
+	case "", PlacementRoundRobin, PlacementMostFree, PlacementHash:
+	default:
+		return errors.Errorf("placement policy %s not supported", c.Placement)
+	}
+	switch c.EvictionPolicy {
+	case "", EvictLRU, EvictFIFO:
+	default:
+		return errors.Errorf("eviction policy %s not supported", c.EvictionPolicy)
+	}
+	if c.HighWatermark < 0 || c.HighWatermark > 100 || c.LowWatermark < 0 || c.LowWatermark > 100 {
+		return errors.New("disk watermarks should be percentages between 0 and 100")
 	}
+	if c.CacheExpiration < 0 || c.CleanupInterval < 0 {
+		return errors.New("cache expiration and cleanup interval can not be negative")
+	}
+	err = c.Upstream.Validate()
+	if err != nil {
+		return err
+	}
+	if c.EncryptionKey != nil {
+		_, err = newEncryptor(c.EncryptionKey)
+		if err != nil {
+			return errors.Wrap(err, "invalid encryption key")
+		}
+	}
+
+	return nil
+}
 
-	if minSize < 0 {
-		minSize = 0
+// New returns a new Cache instance
+func New(c *Config) (*Cache, error) {
+	b, err := newBackend(c)
+	if err != nil {
+		return nil, err
 	}
 
 	return &Cache{
-		b:       b,
-		minSize: minSize,
+		b: b,
 	}, nil
 }
 
 // Cache represents a cache instance
 type Cache struct {
-	b       *backend
-	minSize int
+	b *backend
 }
 
 // CopyFromCache returns reader where the cached (or proxied) body is written to
 func (c *Cache) CopyFromCache(res http.ResponseWriter, req *http.Request) error {
+	if c.b.isOffline() {
+		return c.b.copyOffline(res, req)
+	}
 	e, err := c.b.findEntryByRequest(req)
 	if err != nil && err != ErrEntryNotFound {
 		return errors.Wrap(err, "failed to search entry")
 	}
 	if err == ErrEntryNotFound {
+		// another process sharing the cache might have cached the request
+		err = c.b.sync()
+		if err != nil {
+			log.Errorf("Failed to sync backend file: %s", err)
+		}
+		e, err = c.b.findEntryByRequest(req)
+	}
+	route := c.b.route(req.URL.Path)
+	if err == ErrEntryNotFound {
+		if !c.b.admitFrequency(route, req.URL.Path+"?"+req.URL.Query().Encode()) {
+			setRequestEntry(req, route, "")
+			c.b.setOutcome(req, OutcomeBypass)
+			return ErrNoCache
+		}
 		e, err = c.b.addEntry(req.URL.Path, req.URL.Query())
 		if err != nil {
 			return err
 		}
 	}
+	setRequestEntry(req, route, e)
+
+	err = c.b.proxy(e, res, req)
+	if err == ErrNoCache {
+		c.b.setOutcome(req, OutcomeBypass)
+	}
+
+	return err
+}
+
+// Reconfigure replaces the routes and the cache expiration of the cache
+// Downloads in progress continue with the rules they were started with
+func (c *Cache) Reconfigure(routes []*Route, expiration time.Duration) error {
+	err := ValidateRoutes(routes)
+	if err != nil {
+		return err
+	}
+	c.b.reconfigure(routes, expiration)
+
+	return nil
+}
+
+// PassThrough checks if the cache only proxies requests because all cache volumes are full
+func (c *Cache) PassThrough() bool {
+	return c.b.isPassThrough()
+}
 
-	return c.b.proxy(e, res, req)
+// RouteName returns the name of the route of a request path, empty if no route matches
+func (c *Cache) RouteName(reqPath string) string {
+	return c.b.routeName(reqPath)
 }
@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrChecksumMismatch represents an error where the downloaded body does not match the published checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrChecksumNotFound represents an error where no published checksum was found for a file
+	ErrChecksumNotFound = errors.New("checksum not found")
+)
+
+// ChecksumRule represents a rule to verify downloads against checksums published by the proxy target
+// Either Sidecar or Manifest should be provided
+type ChecksumRule struct {
+	// Algorithm represents the hash algorithm of the published checksums (sha256, sha512, sha1 or md5)
+	Algorithm string `json:"algorithm"`
+	// Sidecar represents the suffix of the checksum file next to the artifact (eg: .sha256)
+	Sidecar string `json:"sidecar,omitempty"`
+	// Manifest represents the name of the checksum manifest in the directory of the artifact (eg: SHA256SUMS)
+	Manifest string `json:"manifest,omitempty"`
+	// Required fails the download if no checksum is published for the artifact
+	Required bool `json:"required"`
+}
+
+// newHash returns a new hash for the rule algorithm
+func (r *ChecksumRule) newHash() (hash.Hash, error) {
+	switch strings.ToLower(r.Algorithm) {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, errors.Errorf("checksum algorithm %s not supported", r.Algorithm)
+	}
+}
+
+// validate checks if the rule is usable
+func (r *ChecksumRule) validate() error {
+	if r.Sidecar == "" && r.Manifest == "" {
+		return errors.New("checksum rule requires a sidecar suffix or manifest name")
+	}
+	_, err := r.newHash()
+	return err
+}
+
+// isChecksumFile checks if the request path is a checksum file of this rule itself
+func (r *ChecksumRule) isChecksumFile(reqPath string) bool {
+	if r.Sidecar != "" && strings.HasSuffix(reqPath, r.Sidecar) {
+		return true
+	}
+	return r.Manifest != "" && path.Base(reqPath) == r.Manifest
+}
+
+// checksumPath returns the request path where the checksum of the provided path is published
+func (r *ChecksumRule) checksumPath(reqPath string) string {
+	if r.Sidecar != "" {
+		return reqPath + r.Sidecar
+	}
+	return path.Join(path.Dir(reqPath), r.Manifest)
+}
+
+// parseChecksum returns the checksum of file from the contents of a sidecar or manifest file
+// Lines are expected in the format of sha256sum and friends: `<hex digest>  [*]<file name>`
+// Sidecars are allowed to only contain a digest
+func (r *ChecksumRule) parseChecksum(data []byte, file string) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			if r.Sidecar == "" {
+				continue
+			}
+		} else {
+			name := strings.TrimPrefix(fields[1], "*")
+			name = strings.TrimPrefix(name, "./")
+			if path.Base(name) != file {
+				continue
+			}
+		}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode checksum of %s", file)
+		}
+		return sum, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read checksum file")
+	}
+
+	return nil, ErrChecksumNotFound
+}
+
+// newVerifier returns a verifier for the provided request path
+// fetch is used to retrieve the published checksum file from the proxy target
+func newVerifier(rule *ChecksumRule, reqPath string, fetch func(string) ([]byte, error)) (*verifier, error) {
+	h, err := rule.newHash()
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifier{
+		Hash:    h,
+		rule:    rule,
+		reqPath: reqPath,
+		fetch:   fetch,
+	}, nil
+}
+
+// verifier hashes a body written to it and compares it to the published checksum
+type verifier struct {
+	hash.Hash
+	rule    *ChecksumRule
+	reqPath string
+	fetch   func(string) ([]byte, error)
+}
+
+// verify compares the hash of the data written to the verifier with the published checksum
+func (v *verifier) verify() error {
+	data, err := v.fetch(v.rule.checksumPath(v.reqPath))
+	if err != nil {
+		if v.rule.Required {
+			return errors.Wrapf(err, "failed to fetch checksum for %s", v.reqPath)
+		}
+		return nil
+	}
+	expected, err := v.rule.parseChecksum(data, path.Base(v.reqPath))
+	if err == ErrChecksumNotFound && !v.rule.Required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	actual := v.Sum(nil)
+	if !bytes.Equal(expected, actual) {
+		return errors.Wrapf(ErrChecksumMismatch, "%s: expected %s, got %s", v.reqPath, hex.EncodeToString(expected), hex.EncodeToString(actual))
+	}
+
+	return nil
+}
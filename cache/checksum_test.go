@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChecksum(t *testing.T) {
+	assert := assert.New(t)
+	digest := sha256.Sum256([]byte("foo"))
+	sum := hex.EncodeToString(digest[:])
+
+	sidecar := &ChecksumRule{Algorithm: "sha256", Sidecar: ".sha256"}
+	result, err := sidecar.parseChecksum([]byte(sum+"\n"), "foo.tar")
+	assert.NoError(err)
+	assert.Equal(digest[:], result)
+
+	result, err = sidecar.parseChecksum([]byte(sum+"  foo.tar\n"), "foo.tar")
+	assert.NoError(err)
+	assert.Equal(digest[:], result)
+
+	manifest := &ChecksumRule{Algorithm: "sha256", Manifest: "SHA256SUMS"}
+	data := []byte("0000  bar.tar\n" + sum + " *./foo.tar\n")
+	result, err = manifest.parseChecksum(data, "foo.tar")
+	assert.NoError(err)
+	assert.Equal(digest[:], result)
+
+	_, err = manifest.parseChecksum(data, "baz.tar")
+	assert.Equal(ErrChecksumNotFound, err)
+
+	assert.Equal("/dists/SHA256SUMS", manifest.checksumPath("/dists/foo.tar"))
+	assert.Equal("/dists/foo.tar.sha256", sidecar.checksumPath("/dists/foo.tar"))
+	assert.True(manifest.isChecksumFile("/dists/SHA256SUMS"))
+	assert.True(sidecar.isChecksumFile("/dists/foo.tar.sha256"))
+	assert.False(sidecar.isChecksumFile("/dists/foo.tar"))
+}
+
+func TestVerifier(t *testing.T) {
+	assert := assert.New(t)
+	digest := sha256.Sum256([]byte("foo"))
+	published := map[string]string{
+		"/foo.tar.sha256": hex.EncodeToString(digest[:]),
+	}
+	fetch := func(reqPath string) ([]byte, error) {
+		data, ok := published[reqPath]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return []byte(data), nil
+	}
+	rule := &ChecksumRule{Algorithm: "sha256", Sidecar: ".sha256", Required: true}
+
+	v, err := newVerifier(rule, "/foo.tar", fetch)
+	assert.NoError(err)
+	v.Write([]byte("foo"))
+	assert.NoError(v.verify())
+
+	v, err = newVerifier(rule, "/foo.tar", fetch)
+	assert.NoError(err)
+	v.Write([]byte("poisoned"))
+	assert.Equal(ErrChecksumMismatch, errors.Cause(v.verify()))
+
+	v, err = newVerifier(rule, "/bar.tar", fetch)
+	assert.NoError(err)
+	assert.Error(v.verify())
+
+	rule.Required = false
+	v, err = newVerifier(rule, "/bar.tar", fetch)
+	assert.NoError(err)
+	assert.NoError(v.verify())
+}
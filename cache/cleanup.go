@@ -1,8 +1,8 @@
 package cache
 
 import (
+	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -16,6 +16,7 @@ func (b *backend) cleanup(quit <-chan struct{}) {
 	for {
 		select {
 		case <-ticker.C:
+			b.checkVolumes()
 			b.markExpired()
 			b.cleanCacheDir()
 		case <-quit:
@@ -26,20 +27,33 @@ func (b *backend) cleanup(quit <-chan struct{}) {
 }
 
 func (b *backend) markExpired() {
-	if b.cacheExpiration == 0 {
+	expiration := b.expiration()
+	if expiration == 0 {
 		return
 	}
 	log.Debug("Started marking expired cache entries.")
-	for eID, e := range b.data {
-		if e.Status == StateCached {
-			if e.expired(b.cacheExpiration) {
+	for eID, e := range b.entries() {
+		e.m.Lock()
+		state, expired := e.Status, e.expired(expiration)
+		e.m.Unlock()
+		if state == StateNoCache && expired {
+			// reconsider caching the entry on its next request
+			err := b.setEntryState(eID, StateInit)
+			if err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+		if state == StateCached {
+			if expired {
 				log.Debugf("Entry %s has expired", eID)
-				err := b.setEntryState(eID, StateInit, true)
+				e.markRefresh()
+				err := b.setEntryState(eID, StateInit)
 				if err != nil {
 					log.Error(err)
 					continue
 				}
-				err = b.setEntryCacheFile(eID, "", true)
+				err = b.setEntryCacheFile(eID, "")
 				if err != nil {
 					log.Error(err)
 					continue
@@ -52,15 +66,23 @@ func (b *backend) markExpired() {
 
 func (b *backend) cleanCacheDir() {
 	log.Debug("Started deleting invalid cache files.")
+	// load the entries of other processes sharing the cache so their files are not deleted
+	err := b.sync()
+	if err != nil {
+		log.Errorf("Failed to sync backend file: %s", err)
+		return
+	}
 
-	filesInUse := []string{}
-	for eID, e := range b.data {
-		if e.Status == StateCached || e.Status == StateInProgress {
-			f := filepath.Base(e.CachedFile)
-			filesInUse = append(filesInUse, f)
+	filesInUse := map[string]bool{}
+	for eID, e := range b.entries() {
+		e.m.Lock()
+		state, file := e.Status, e.CachedFile
+		e.m.Unlock()
+		if state == StateCached || state == StateInProgress {
+			filesInUse[filepath.Clean(file)] = true
 		} else {
-			if e.CachedFile != "" {
-				err := b.setEntryCacheFile(eID, "", true)
+			if file != "" {
+				err := b.setEntryCacheFile(eID, "")
 				if err != nil {
 					log.Error(err)
 					continue
@@ -68,25 +90,37 @@ func (b *backend) cleanCacheDir() {
 			}
 		}
 	}
+	log.Debugf("%d files currently in use.", len(filesInUse))
 
-	if len(filesInUse) == 0 {
-		log.Debug("No files currently in use.")
-	} else {
-		log.Debugf("Current files in use: %s", strings.Join(filesInUse, ", "))
-	}
-
-	currentFiles, err := listFiles(b.cacheDir)
-	if err != nil {
-		log.Errorf("Failed to list cache dir files: %s", err)
-	}
-	for _, cf := range currentFiles {
-		if !inStringSlice(filesInUse, cf) {
-			log.Debugf("Deleting file %s", cf)
-			err = deletefile(b.cacheDir, cf)
+	for _, v := range b.volumes {
+		if !v.isAvailable() {
+			continue
+		}
+		var used int64
+		err := walkFiles(v.Dir, func(file string, info os.FileInfo) {
+			if filesInUse[file] {
+				used += info.Size()
+				return
+			}
+			if isTempFile(file) {
+				// cache file that is being written
+				return
+			}
+			if time.Since(info.ModTime()) < orphanGracePeriod {
+				// cache file that was just written, possibly by another process that did not save its entry yet
+				return
+			}
+			log.Debugf("Deleting file %s", file)
+			err := os.Remove(file)
 			if err != nil {
-				log.Errorf("Failed to delete file %s: %s", cf, err)
+				log.Errorf("Failed to delete file %s: %s", file, err)
 			}
+		})
+		if err != nil {
+			log.Errorf("Failed to list cache dir files: %s", err)
+			continue
 		}
+		v.setUsed(used)
 	}
 
 	log.Debug("Finished deleting invalid cache files.")
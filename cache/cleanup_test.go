@@ -1,6 +1,9 @@
 package cache
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"sync"
 	"testing"
 	"time"
@@ -74,3 +77,41 @@ func TestMarkExpired(t *testing.T) {
 		assert.Equal(StateInit, b.data[i].Status)
 	}
 }
+
+func TestMigrateAndCleanCacheDir(t *testing.T) {
+	assert := assert.New(t)
+	nosave = true
+	volumes, clean := newTestVolumes(t, 1)
+	defer clean()
+	dir := volumes[0].Dir
+
+	flat := path.Join(dir, "foo_1234.blob")
+	assert.NoError(ioutil.WriteFile(flat, []byte("foo"), filePerm))
+	orphan := path.Join(dir, "ab", "cd", "abcd.blob")
+	assert.NoError(os.MkdirAll(path.Dir(orphan), dirPerm))
+	assert.NoError(ioutil.WriteFile(orphan, []byte("bar"), filePerm))
+	// recently written files might belong to another process that did not save its entry yet
+	recent := path.Join(dir, "ef", "gh", "efgh.blob")
+	assert.NoError(os.MkdirAll(path.Dir(recent), dirPerm))
+	assert.NoError(ioutil.WriteFile(recent, []byte("baz"), filePerm))
+	old := time.Now().Add(-orphanGracePeriod - time.Minute)
+	assert.NoError(os.Chtimes(orphan, old, old))
+
+	b := &backend{
+		volumes: volumes,
+		m:       &sync.Mutex{},
+		data: map[string]*Entry{
+			"foo": {Status: StateCached, Volume: dir, CachedFile: flat, m: &sync.Mutex{}},
+		},
+	}
+	b.migrateLayout()
+	b.cleanCacheDir()
+
+	migrated := b.data["foo"].CachedFile
+	assert.NotEqual(flat, migrated)
+	assert.True(fileExists(migrated))
+	assert.False(fileExists(flat))
+	assert.False(fileExists(orphan))
+	assert.True(fileExists(recent))
+	assert.Equal(int64(3), volumes[0].used)
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EncodingGzip represents a gzip compressed cache file
+	EncodingGzip = "gzip"
+	// EncodingZstd represents a zstd compressed cache file
+	EncodingZstd = "zstd"
+)
+
+// CompressionRule represents a rule for which cached bodies are compressed on disk
+// A body is compressed if either its content type or its request path matches the rule
+type CompressionRule struct {
+	// Encoding represents the compression used for the cache file (gzip or zstd)
+	Encoding string `json:"encoding"`
+	// ContentTypes represents content type prefixes to compress (eg: text/, application/json)
+	ContentTypes []string `json:"content_types,omitempty"`
+	// Paths represents request path patterns to compress (eg: *.json, /dists/*/Packages)
+	// Patterns without a slash are matched against the file name only
+	Paths []string `json:"paths,omitempty"`
+}
+
+// validate checks if the rule is usable
+func (r *CompressionRule) validate() error {
+	if r.Encoding != EncodingGzip && r.Encoding != EncodingZstd {
+		return errors.Errorf("compression encoding %s not supported", r.Encoding)
+	}
+	for _, p := range r.Paths {
+		_, err := path.Match(p, "")
+		if err != nil {
+			return errors.Wrapf(err, "invalid path pattern %s", p)
+		}
+	}
+
+	return nil
+}
+
+// matches checks if the rule applies to the provided request path or content type
+func (r *CompressionRule) matches(reqPath, contentType string) bool {
+	if contentType != "" {
+		for _, ct := range r.ContentTypes {
+			if strings.HasPrefix(contentType, ct) {
+				return true
+			}
+		}
+	}
+	for _, p := range r.Paths {
+		name := reqPath
+		if !strings.Contains(p, "/") {
+			name = path.Base(reqPath)
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressionFor returns the encoding a body should be stored with according to the route
+// returns an empty string if the body should be stored as is
+func compressionFor(route *Route, reqPath string, headers http.Header) string {
+	if route == nil {
+		return ""
+	}
+	// the body is already encoded by the proxy target
+	if enc := headers.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return ""
+	}
+	contentType := headers.Get("Content-Type")
+	for _, r := range route.Compression {
+		if r.matches(reqPath, contentType) {
+			return r.Encoding
+		}
+	}
+
+	return ""
+}
+
+// newEncoder wraps a writer so that data written to it is compressed with the provided encoding
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case EncodingZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, errors.Errorf("compression encoding %s not supported", encoding)
+	}
+}
+
+// newDecoder wraps a reader so that data read from it is decompressed with the provided encoding
+func newDecoder(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	case EncodingZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, errors.Errorf("compression encoding %s not supported", encoding)
+	}
+}
+
+// acceptsEncoding checks if the Accept-Encoding header of a request allows the provided encoding
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, header := range req.Header.Values("Accept-Encoding") {
+		for _, e := range strings.Split(header, ",") {
+			parts := strings.Split(e, ";")
+			name := strings.TrimSpace(parts[0])
+			if name != encoding && name != "*" {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "q=") {
+					continue
+				}
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	return false
+}
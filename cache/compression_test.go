@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionFor(t *testing.T) {
+	assert := assert.New(t)
+	route := &Route{
+		Compression: []*CompressionRule{
+			{Encoding: EncodingZstd, ContentTypes: []string{"application/json"}},
+			{Encoding: EncodingGzip, Paths: []string{"Packages", "/logs/*"}},
+		},
+	}
+	headers := func(contentType, encoding string) http.Header {
+		h := http.Header{}
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Encoding", encoding)
+		return h
+	}
+
+	assert.Equal(EncodingZstd, compressionFor(route, "/index", headers("application/json; charset=utf-8", "")))
+	assert.Equal(EncodingGzip, compressionFor(route, "/dists/main/Packages", headers("", "")))
+	assert.Equal(EncodingGzip, compressionFor(route, "/logs/build.log", headers("text/plain", "")))
+	assert.Equal("", compressionFor(route, "/logs/2020/build.log", headers("text/plain", "")))
+	assert.Equal("", compressionFor(route, "/index", headers("application/json", "gzip")))
+	assert.Equal("", compressionFor(nil, "/index", headers("application/json", "")))
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert := assert.New(t)
+	req := func(acceptEncoding string) *http.Request {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		return r
+	}
+
+	assert.True(acceptsEncoding(req("gzip, deflate"), EncodingGzip))
+	assert.True(acceptsEncoding(req("*"), EncodingZstd))
+	assert.False(acceptsEncoding(req("gzip;q=0, deflate"), EncodingGzip))
+	assert.False(acceptsEncoding(req("deflate"), EncodingGzip))
+	assert.False(acceptsEncoding(req(""), EncodingGzip))
+}
+
+func TestWriteEncoded(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	data := []byte("Package: foo\nVersion: 1.0\n")
+
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		file := path.Join(dir, encoding+".blob")
+		f, err := os.Create(file)
+		assert.NoError(err)
+		assert.NoError(writeEncoded(f, bytes.NewReader(data), encoding))
+		f.Close()
+
+		f, err = os.Open(file)
+		assert.NoError(err)
+		dec, err := newDecoder(f, encoding)
+		assert.NoError(err)
+		result, err := ioutil.ReadAll(dec)
+		assert.NoError(err)
+		assert.Equal(data, result)
+		dec.Close()
+		f.Close()
+	}
+}
@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// EvictLRU evicts the least recently used entries first
+	EvictLRU = "lru"
+	// EvictFIFO evicts the oldest entries first
+	EvictFIFO = "fifo"
+)
+
+// diskCheckInterval represents the amount of time in between disk watermark checks
+const diskCheckInterval = 30 * time.Second
+
+// diskSpace returns the total size and the amount of available bytes of the filesystem of a dir
+var diskSpace = statDiskSpace
+
+// usage returns the percentage of the volume that is in use
+// This is the highest of the disk usage of the filesystem and the used part of the volume capacity
+func (v *volume) usage() float64 {
+	var usage float64
+	total, free, err := diskSpace(v.Dir)
+	if err != nil {
+		log.Debugf("Failed to get disk space of %s: %s", v.Dir, err)
+	} else if total > 0 {
+		usage = float64(total-free) / float64(total) * 100
+	}
+	v.m.Lock()
+	defer v.m.Unlock()
+	if v.Capacity > 0 {
+		if capUsage := float64(v.used) / float64(v.Capacity) * 100; capUsage > usage {
+			usage = capUsage
+		}
+	}
+
+	return usage
+}
+
+// isFull checks if the volume is over the high disk watermark
+func (v *volume) isFull() bool {
+	v.m.Lock()
+	defer v.m.Unlock()
+	return v.full
+}
+
+// setFull sets if the volume is over the high disk watermark
+// Returns true if it changed
+func (v *volume) setFull(full bool) bool {
+	v.m.Lock()
+	defer v.m.Unlock()
+	changed := v.full != full
+	v.full = full
+
+	return changed
+}
+
+func (b *backend) watchDisk(quit <-chan struct{}) {
+	if b.highWatermark <= 0 {
+		return
+	}
+	ticker := time.NewTicker(diskCheckInterval)
+	for {
+		select {
+		case <-ticker.C:
+			b.checkDisk()
+		case <-quit:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// checkDisk evicts entries of volumes that are used over the high watermark until they are under the low watermark
+// Volumes that stay over the high watermark are not used to store new cache files,
+// if no volume is left, the cache switches to pass through proxying
+func (b *backend) checkDisk() {
+	if b.highWatermark <= 0 {
+		return
+	}
+	b.diskM.Lock()
+	defer b.diskM.Unlock()
+
+	passThrough := true
+	for _, v := range b.volumes {
+		if !v.isAvailable() {
+			continue
+		}
+		usage := v.usage()
+		if usage >= b.highWatermark {
+			log.Warnf("Cache volume %s is %.1f%% full, evicting entries", v.Dir, usage)
+			b.evict(v)
+			usage = v.usage()
+		}
+		full := usage >= b.highWatermark
+		if v.setFull(full) {
+			if full {
+				log.Warnf("Cache volume %s is still %.1f%% full after eviction, not storing new cache files on it", v.Dir, usage)
+			} else {
+				log.Infof("Cache volume %s is %.1f%% full, storing new cache files on it", v.Dir, usage)
+			}
+		}
+		if !full {
+			passThrough = false
+		}
+	}
+
+	b.m.Lock()
+	changed := b.passThrough != passThrough
+	b.passThrough = passThrough
+	b.m.Unlock()
+	if changed {
+		if passThrough {
+			log.Warn("All cache volumes are full, switching to pass through proxying")
+		} else {
+			log.Info("Cache volumes have free space, resuming caching")
+		}
+	}
+}
+
+// isPassThrough checks if the cache is in pass through mode because all volumes are full
+func (b *backend) isPassThrough() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.passThrough
+}
+
+// evict evicts cached entries of a volume by the eviction policy until its usage is at or below the low watermark
+func (b *backend) evict(v *volume) {
+	type candidate struct {
+		id  string
+		e   *Entry
+		key time.Time // entries with the oldest key are evicted first
+	}
+	candidates := []candidate{}
+	for id, e := range b.entries() {
+		e.m.Lock()
+		if e.Status == StateCached && e.Volume == v.Dir {
+			key := e.LastAccess.Time()
+			if b.evictionPolicy == EvictFIFO {
+				key = e.InitTime.Time()
+			}
+			candidates = append(candidates, candidate{id: id, e: e, key: key})
+		}
+		e.m.Unlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].key.Before(candidates[j].key)
+	})
+
+	evicted := 0
+	for _, c := range candidates {
+		if v.usage() <= b.lowWatermark {
+			break
+		}
+		if b.evictEntry(c.id, c.e, v) {
+			evicted++
+		}
+	}
+	if evicted == 0 {
+		return
+	}
+	log.Infof("Evicted %d entries from cache volume %s", evicted, v.Dir)
+
+	b.m.Lock()
+	err := b.save()
+	b.m.Unlock()
+	if err != nil {
+		log.Errorf("Failed to save evicted entries: %s", err)
+	}
+}
+
+// evictEntry resets a cached entry and deletes its cache file
+// The backend file is not saved
+func (b *backend) evictEntry(id string, e *Entry, v *volume) bool {
+	e.m.Lock()
+	if e.Status != StateCached {
+		e.m.Unlock()
+		return false
+	}
+	file := e.CachedFile
+	e.Status = StateInit
+	e.CachedFile = ""
+	e.m.Unlock()
+	if b.mem != nil {
+		b.mem.remove(id)
+	}
+
+	info, err := os.Stat(file)
+	if err == nil {
+		v.addUsed(-info.Size())
+	}
+	err = os.Remove(file)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to delete evicted cache file %s: %s", file, err)
+	}
+	log.Debugf("Evicted entry %s", id)
+
+	return true
+}
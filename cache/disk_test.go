@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDisk(t *testing.T) {
+	assert := assert.New(t)
+	nosave = true
+	diskSpace = func(dir string) (int64, int64, error) {
+		return 100, 100, nil
+	}
+	defer func() { diskSpace = statDiskSpace }()
+
+	volumes, clean := newTestVolumes(t, 1)
+	defer clean()
+	v := volumes[0]
+	v.Capacity = 40
+	b := &backend{
+		volumes:       volumes,
+		m:             &sync.Mutex{},
+		diskM:         &sync.Mutex{},
+		highWatermark: 90,
+		lowWatermark:  50,
+		data:          map[string]*Entry{},
+	}
+
+	// 4 cache files of 10 bytes, accessed in order
+	for i, id := range []string{"1", "2", "3", "4"} {
+		file := v.generateCacheFileName(id)
+		e := &Entry{
+			Status:     StateCached,
+			Volume:     v.Dir,
+			CachedFile: file,
+			LastAccess: JSONTime(time.Now().Add(time.Duration(i) * time.Minute)),
+			m:          &sync.Mutex{},
+		}
+		assert.NoError(createTestFile(file, 10))
+		v.addUsed(10)
+		b.data[id] = e
+	}
+
+	b.checkDisk()
+	// least recently used entries are evicted until under the low watermark
+	assert.Equal(StateInit, b.data["1"].Status)
+	assert.Equal(StateInit, b.data["2"].Status)
+	assert.Equal(StateCached, b.data["3"].Status)
+	assert.Equal(StateCached, b.data["4"].Status)
+	assert.Equal(int64(20), v.used)
+	assert.False(b.isPassThrough())
+
+	// switches to pass through if eviction can not free enough space
+	diskSpace = func(dir string) (int64, int64, error) {
+		return 100, 5, nil
+	}
+	b.checkDisk()
+	assert.True(v.isFull())
+	assert.True(b.isPassThrough())
+	_, err := b.pickVolume("/foo")
+	assert.Equal(ErrNoVolume, err)
+}
+
+func createTestFile(file string, size int) error {
+	err := os.MkdirAll(filepath.Dir(file), dirPerm)
+	if err != nil {
+		return err
+	}
+	f, err := createAtomic(file)
+	if err != nil {
+		return err
+	}
+	f.Write(make([]byte, size))
+	return f.commit()
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package cache
+
+import (
+	"syscall"
+)
+
+// statDiskSpace returns the total size and the amount of available bytes of the filesystem of dir
+func statDiskSpace(dir string) (int64, int64, error) {
+	st := syscall.Statfs_t{}
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int64(st.Blocks) * int64(st.Bsize), int64(st.Bavail) * int64(st.Bsize), nil
+}
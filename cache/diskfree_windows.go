@@ -0,0 +1,10 @@
+package cache
+
+import (
+	"github.com/pkg/errors"
+)
+
+// statDiskSpace returns the total size and the amount of available bytes of the filesystem of dir
+func statDiskSpace(dir string) (int64, int64, error) {
+	return 0, 0, errors.New("disk space is not supported on windows")
+}
@@ -0,0 +1,292 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypted files start with a header of the magic bytes followed by a random nonce prefix.
+// The plaintext is split in chunks that are sealed separately with AES-GCM,
+// the nonce of a chunk is the nonce prefix followed by the chunk index and a flag marking the last chunk.
+// This allows to decrypt any chunk on its own, so encrypted files can be read from any offset,
+// while reordering, dropping or truncating chunks fails authentication.
+const (
+	encryptionMagic     = "CSE1"
+	encryptionChunkSize = 64 * 1024
+	noncePrefixSize     = 7
+	encryptionHeaderLen = len(encryptionMagic) + noncePrefixSize
+)
+
+var (
+	// ErrEncryptionKeyMissing represents an error where encrypted data is read without an encryption key
+	ErrEncryptionKeyMissing = errors.New("data is encrypted but no encryption key is provided")
+)
+
+// ParseEncryptionKey parses an AES key from a hex or base64 encoded string or from raw bytes
+// The key needs to be 16, 24 or 32 bytes long
+// Encoded keys take precedence, eg: 32 hex characters are a 16 byte key and not a raw 32 byte key
+func ParseEncryptionKey(data []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(s); err == nil && validKeySize(len(key)) {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && validKeySize(len(key)) {
+		return key, nil
+	}
+	if validKeySize(len(data)) {
+		return data, nil
+	}
+
+	return nil, errors.New("encryption key should be 16, 24 or 32 bytes, raw or hex/base64 encoded")
+}
+
+func validKeySize(size int) bool {
+	return size == 16 || size == 24 || size == 32
+}
+
+// isEncrypted checks if data starts with the header of an encrypted file
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptionMagic))
+}
+
+func newEncryptor(key []byte) (*encryptor, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AES-GCM")
+	}
+
+	return &encryptor{aead: aead}, nil
+}
+
+// encryptor encrypts and decrypts files with chunked AES-GCM
+type encryptor struct {
+	aead cipher.AEAD
+}
+
+// nonce returns the nonce of a chunk
+func (e *encryptor) nonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, e.aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encrypt returns the encrypted form of data
+func (e *encryptor) encrypt(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := e.newWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decrypt returns the plaintext of encrypted data
+func (e *encryptor) decrypt(data []byte) ([]byte, error) {
+	r, err := e.newReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// newWriter returns a writer that encrypts data written to it to w
+// The writer needs to be closed to write the last chunk
+func (e *encryptor) newWriter(w io.Writer) (io.WriteCloser, error) {
+	header := make([]byte, encryptionHeaderLen)
+	copy(header, encryptionMagic)
+	_, err := rand.Read(header[len(encryptionMagic):])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		e:      e,
+		w:      w,
+		header: header,
+		buf:    make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+type encryptWriter struct {
+	e      *encryptor
+	w      io.Writer
+	header []byte
+	buf    []byte
+	index  uint32
+}
+
+// Write implements io.Writer
+// A full chunk is only sealed once more data is written, as the last chunk is sealed differently
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == encryptionChunkSize {
+			err := w.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):encryptionChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the last chunk
+func (w *encryptWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *encryptWriter) seal(last bool) error {
+	nonce := w.e.nonce(w.header[len(encryptionMagic):], w.index, last)
+	_, err := w.w.Write(w.e.aead.Seal(nil, nonce, w.buf, w.header))
+	if err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.index++
+
+	return nil
+}
+
+// newReader returns a reader that decrypts the encrypted data of size in r
+// The returned reader supports seeking, only the chunks that are read are decrypted
+func (e *encryptor) newReader(r io.ReaderAt, size int64) (*decryptReader, error) {
+	header := make([]byte, encryptionHeaderLen)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read encryption header")
+	}
+	if !isEncrypted(header) {
+		return nil, errors.New("data is not encrypted")
+	}
+
+	sealedChunkSize := int64(encryptionChunkSize + e.aead.Overhead())
+	body := size - int64(encryptionHeaderLen)
+	chunks := (body + sealedChunkSize - 1) / sealedChunkSize
+	if chunks == 0 {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	plainSize := body - chunks*int64(e.aead.Overhead())
+	if plainSize < 0 {
+		return nil, errors.New("encrypted data is truncated")
+	}
+
+	dr := &decryptReader{
+		e:         e,
+		r:         r,
+		header:    header,
+		size:      plainSize,
+		lastChunk: chunks - 1,
+		chunk:     -1,
+	}
+	// authenticate the last chunk up front so truncated data is detected
+	// before any data is returned
+	err = dr.open(dr.lastChunk)
+	if err != nil {
+		return nil, err
+	}
+
+	return dr, nil
+}
+
+type decryptReader struct {
+	e         *encryptor
+	r         io.ReaderAt
+	header    []byte
+	size      int64 // plaintext size
+	pos       int64 // plaintext reading position
+	lastChunk int64
+	chunk     int64 // index of the decrypted chunk in buf
+	buf       []byte
+}
+
+// Read implements io.Reader
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / encryptionChunkSize
+	if index != r.chunk {
+		err := r.open(index)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[r.pos-index*encryptionChunkSize:])
+	r.pos += int64(n)
+
+	return n, nil
+}
+
+// open decrypts the chunk with the provided index into the buffer
+func (r *decryptReader) open(index int64) error {
+	sealedChunkSize := int64(encryptionChunkSize + r.e.aead.Overhead())
+	sealed := make([]byte, sealedChunkSize)
+	n, err := r.r.ReadAt(sealed, int64(encryptionHeaderLen)+index*sealedChunkSize)
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "failed to read encrypted chunk")
+	}
+	nonce := r.e.nonce(r.header[len(encryptionMagic):], uint32(index), index == r.lastChunk)
+	r.buf, err = r.e.aead.Open(r.buf[:0], nonce, sealed[:n], r.header)
+	if err != nil {
+		r.chunk = -1
+		return errors.Wrapf(err, "failed to decrypt chunk %d", index)
+	}
+	r.chunk = index
+
+	return nil
+}
+
+// Seek implements io.Seeker
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+
+	return offset, nil
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEncryptionKey(t *testing.T) {
+	// raw keys are binary, a raw key of base64 characters is decoded
+	raw := bytes.Repeat([]byte{0xff}, 32)
+	key16 := bytes.Repeat([]byte{0x42}, 16)
+	key24 := bytes.Repeat([]byte{0x42}, 24)
+	key32 := bytes.Repeat([]byte{0x42}, 32)
+	tests := []struct {
+		name string
+		data []byte
+		key  []byte
+	}{
+		{name: "raw", data: raw, key: raw},
+		{name: "raw ascii", data: []byte("this key is 32 characters long!!"), key: []byte("this key is 32 characters long!!")},
+		{name: "hex", data: []byte(hex.EncodeToString(key32) + "\n"), key: key32},
+		// 32 hex characters are a 16 byte key, not a raw 32 byte key
+		{name: "hex of the length of a raw key", data: []byte(hex.EncodeToString(key16)), key: key16},
+		{name: "base64", data: []byte(base64.StdEncoding.EncodeToString(key32) + "\n"), key: key32},
+		// 24 base64 characters are a 16 byte key, not a raw 24 byte key
+		{name: "base64 of the length of a raw key", data: []byte(base64.StdEncoding.EncodeToString(key16)), key: key16},
+		{name: "base64 of a 24 byte key", data: []byte(base64.StdEncoding.EncodeToString(key24)), key: key24},
+		{name: "invalid", data: []byte("foobar")},
+		{name: "invalid hex size", data: []byte(hex.EncodeToString(key16[:10]))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			key, err := ParseEncryptionKey(test.data)
+			if test.key == nil {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(test.key, key)
+		})
+	}
+}
+
+func TestEncryptor(t *testing.T) {
+	assert := assert.New(t)
+	e, err := newEncryptor(bytes.Repeat([]byte{0x42}, 32))
+	assert.NoError(err)
+
+	for _, size := range []int{0, 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		encrypted, err := e.encrypt(data)
+		assert.NoError(err)
+		assert.True(isEncrypted(encrypted))
+
+		result, err := e.decrypt(encrypted)
+		assert.NoError(err)
+		assert.Equal(data, append([]byte{}, result...), "size %d", size)
+
+		// truncating the last chunk fails authentication
+		if size > encryptionChunkSize {
+			_, err = e.decrypt(encrypted[:len(encrypted)-encryptionChunkSize])
+			assert.Error(err)
+		}
+	}
+}
+
+func TestDecryptReaderSeek(t *testing.T) {
+	assert := assert.New(t)
+	e, err := newEncryptor(bytes.Repeat([]byte{0x42}, 16))
+	assert.NoError(err)
+	data := make([]byte, 2*encryptionChunkSize+100)
+	rand.Read(data)
+	encrypted, err := e.encrypt(data)
+	assert.NoError(err)
+
+	r, err := e.newReader(bytes.NewReader(encrypted), int64(len(encrypted)))
+	assert.NoError(err)
+	size, err := r.Seek(0, io.SeekEnd)
+	assert.NoError(err)
+	assert.Equal(int64(len(data)), size)
+
+	offset := int64(encryptionChunkSize - 10)
+	_, err = r.Seek(offset, io.SeekStart)
+	assert.NoError(err)
+	result, err := ioutil.ReadAll(io.LimitReader(r, 20))
+	assert.NoError(err)
+	assert.Equal(data[offset:offset+20], result)
+
+	// tampering with the data fails authentication
+	encrypted[encryptionHeaderLen+1] ^= 0xff
+	_, err = e.decrypt(encrypted)
+	assert.Error(err)
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"encoding/json"
 	"net/url"
 	"sync"
 	"time"
@@ -29,14 +30,77 @@ type Entry struct {
 	// Params represents the URL request params of the cached entry
 	Params url.Values `json:"params"`
 	// Created is the timestamp for when the entry was initialized
-	InitTime JSONTime `json:"innited"`
+	InitTime JSONTime `json:"init_time"`
+	// LastAccess is the timestamp for when the entry was last served from cache
+	LastAccess JSONTime `json:"last_access"`
 	// Status  represents the entry status
 	Status State `json:"status"`
 	// CachedFile represents the file location of the cached request body
 	CachedFile string `json:"cached_file"`
-	m          *sync.Mutex
-	resp       *response
-	readWg     *sync.WaitGroup
+	// Volume represents the cache dir the cached file is stored in
+	Volume string `json:"volume"`
+	// Encoding represents the compression of the cached file (empty if not compressed)
+	Encoding string `json:"encoding,omitempty"`
+	// Encrypted represents if the cached file is encrypted
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Size represents the size of the uncompressed body
+	Size int64 `json:"size"`
+	m    *sync.Mutex
+	// init is held while the entry is initialized, so only one request downloads it
+	init *sync.Mutex
+	resp *response
+	hits int // amount of times the entry was served from cache
+	// downloading represents if the entry is being downloaded by this process
+	downloading bool
+	// refresh represents if the next download replaces an expired or refreshed cached file
+	refresh bool
+}
+
+// key returns the key the entry is cached by
+func (e *Entry) key() string {
+	return e.Path + "?" + e.Params.Encode()
+}
+
+// markRefresh marks the next download of the entry as a refresh of its cached file
+func (e *Entry) markRefresh() {
+	e.m.Lock()
+	e.refresh = true
+	e.m.Unlock()
+}
+
+// newEntry returns a new entry in the init state
+func newEntry(path string, params url.Values) *Entry {
+	return &Entry{
+		Path:   path,
+		Params: params,
+		Status: StateInit,
+		m:      &sync.Mutex{},
+		init:   &sync.Mutex{},
+	}
+}
+
+// marshal returns the entry as it is saved in the backend file
+func (e *Entry) marshal() (json.RawMessage, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return json.Marshal(e)
+}
+
+// isDownloading checks if the entry is being downloaded by this process
+func (e *Entry) isDownloading() bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.downloading
+}
+
+// isExpired checks if the entry is expired, entries do not expire if the expiration is 0
+func (e *Entry) isExpired(expiration time.Duration) bool {
+	if expiration <= 0 {
+		return false
+	}
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.expired(expiration)
 }
 
 // expired checks if entry is expired
@@ -1,11 +1,14 @@
 package cache
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"sync"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -18,39 +21,280 @@ var (
 )
 
 // save writes the current file backend data to the backend file
+// Changes other processes made to the backend file since it was last read are merged first
+// Make sure to execute this when backend is locked
 func (b *backend) save() error {
 	if nosave {
 		return nil
 	}
-	data, err := json.MarshalIndent(b.data, "", "\t")
+	unlock, err := b.lockMetadata(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = b.merge()
+	if err != nil {
+		return err
+	}
+	err = b.writeBackup()
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]json.RawMessage, len(b.data))
+	for id, e := range b.data {
+		entries[id], err = e.marshal()
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal backend data to json")
+		}
+	}
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal backend data to json")
+	}
+	data, err := json.MarshalIndent(&metadataFile{
+		Version: metadataVersion,
+		Entries: raw,
+	}, "", "\t")
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal backend data to json")
 	}
-	err = ioutil.WriteFile(b.filePath, data, filePerm)
+	if b.crypt != nil {
+		data, err = b.crypt.encrypt(data)
+		if err != nil {
+			return errors.Wrap(err, "failed to encrypt backend data")
+		}
+	}
+
+	err = writeFileAtomic(b.filePath, data)
+	if err != nil {
+		return err
+	}
+	b.synced = entries
+	b.syncedInfo, err = os.Stat(b.filePath)
+
+	return err
+}
+
+// writeBackup writes the backend file of an older version as it was read before it is overwritten
+func (b *backend) writeBackup() error {
+	if b.backup == nil {
+		return nil
+	}
+	file := backupFile(b.filePath, b.backupVersion)
+	err := writeFileAtomic(file, b.backup)
+	if err != nil {
+		return errors.Wrap(err, "failed to back up backend file")
+	}
+	log.Infof("Backed up backend file of version %d to %s", b.backupVersion, file)
+	b.backup = nil
+
+	return nil
+}
+
+// writeFileAtomic writes data to file, the file only changes once all data is written and synced
+func writeFileAtomic(file string, data []byte) error {
+	f, err := createAtomic(file)
 	if err != nil {
 		return errors.Wrap(err, "failed to open file for writing")
 	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.abort()
+		return errors.Wrapf(err, "failed to write %s", file)
+	}
+	return f.commit()
+}
+
+// read reads the entries of the backend file
+// Backend files of older versions are migrated to the current version
+// Returns the entries and their JSON in the form save writes them, to detect changes
+func (b *backend) read() (map[string]*Entry, map[string]json.RawMessage, os.FileInfo, error) {
+	info, err := os.Stat(b.filePath)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to read backend file")
+	}
+	original, err := ioutil.ReadFile(b.filePath)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to read backend file")
+	}
+	data := original
+	if isEncrypted(data) {
+		if b.crypt == nil {
+			return nil, nil, nil, ErrEncryptionKeyMissing
+		}
+		data, err = b.crypt.decrypt(data)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "failed to decrypt backend file")
+		}
+	}
+
+	version, raw, err := decodeMetadata(data)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to parse data from backend file")
+	}
+	raw, err = migrateMetadata(version, raw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if version < metadataVersion {
+		// the backup is written before the migrated file is saved
+		b.backup = original
+		b.backupVersion = version
+	}
+
+	entries := map[string]*Entry{}
+	if len(raw) > 0 {
+		err = json.Unmarshal(raw, &entries)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "failed to parse data from backend file")
+		}
+	}
+	canonical := make(map[string]json.RawMessage, len(entries))
+	for id, e := range entries {
+		e.m, e.init = &sync.Mutex{}, &sync.Mutex{}
+		canonical[id], err = json.Marshal(e)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "failed to marshal backend data to json")
+		}
+	}
+
+	return entries, canonical, info, nil
+}
+
+// load reads the entries of a previous run from the backend file
+func (b *backend) load() error {
+	if !fileExists(b.filePath) {
+		return nil
+	}
+	unlock, err := b.lockMetadata(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, canonical, info, err := b.read()
+	if err != nil {
+		return err
+	}
+	b.data = entries
+	b.synced = canonical
+	b.syncedInfo = info
+
 	return nil
 }
 
-// read reads the backend file to in memory objects for the file backend
-func (b *backend) read() error {
-	data, err := ioutil.ReadFile(b.filePath)
+// sync merges the changes other processes made to the backend file
+func (b *backend) sync() error {
+	if nosave {
+		return nil
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	unlock, err := b.lockMetadata(false)
 	if err != nil {
-		return errors.Wrap(err, "failed to read backend file")
+		return err
 	}
+	defer unlock()
 
-	if string(data) == "" || string(data) == "[]" {
+	return b.merge()
+}
+
+// merge merges the entries of the backend file if another process changed it since it was last read or written
+// Entries that were changed by this process and by another process keep the changes of this process
+// Make sure to execute this when backend is locked and the backend file is locked
+func (b *backend) merge() error {
+	info, err := os.Stat(b.filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read backend file")
+	}
+	if b.syncedInfo != nil && os.SameFile(info, b.syncedInfo) && info.ModTime().Equal(b.syncedInfo.ModTime()) {
 		return nil
 	}
-	err = json.Unmarshal(data, &b.data)
+	entries, canonical, info, err := b.read()
 	if err != nil {
-		return errors.Wrap(err, "failed to parse data from backend file")
+		return err
+	}
+
+	for id, data := range canonical {
+		base, known := b.synced[id]
+		local, ok := b.data[id]
+		switch {
+		case !ok && !known:
+			// added by another process
+			b.data[id] = entries[id]
+		case !ok, bytes.Equal(data, base):
+			// deleted by this process or not changed by another process
+		case !known || local.isDownloading() || !b.unchanged(local, base):
+			// changed by this process
+		default:
+			// changed by another process
+			e := entries[id]
+			e.m, e.init, e.resp, e.hits = local.m, local.init, local.resp, local.hits
+			b.data[id] = e
+		}
+	}
+	for id, local := range b.data {
+		if _, ok := canonical[id]; ok {
+			continue
+		}
+		if base, known := b.synced[id]; known && !local.isDownloading() && b.unchanged(local, base) {
+			// deleted by another process
+			delete(b.data, id)
+			if b.mem != nil {
+				b.mem.remove(id)
+			}
+		}
 	}
+	b.synced = canonical
+	b.syncedInfo = info
 
 	return nil
 }
 
+// unchanged checks if an entry is the same as when it was last read or written
+func (b *backend) unchanged(e *Entry, synced json.RawMessage) bool {
+	data, err := e.marshal()
+	return err == nil && bytes.Equal(data, synced)
+}
+
+// pruneEntries drops the loaded entries that can not be used
+// Only entries that are not cached and cached entries of which the cached file
+// still exists on an available volume are kept
+// When other processes share the cache, their entries that are being downloaded are kept as well
+func (b *backend) pruneEntries() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	dropped := 0
+	for id, e := range b.data {
+		if e.Status == StateNoCache {
+			continue
+		}
+		if b.shared && e.Status != StateCached && !b.staleDownload(e) {
+			continue
+		}
+		v := b.findVolume(e.Volume)
+		if e.Status != StateCached || v == nil || !v.isAvailable() || !fileExists(e.CachedFile) {
+			delete(b.data, id)
+			dropped++
+		}
+	}
+	log.Debugf("Loaded %d entries from backend file, dropped %d invalid entries", len(b.data), dropped)
+
+	return b.save()
+}
+
+// staleDownload checks if an entry that is being downloaded is not downloaded by any process
+func (b *backend) staleDownload(e *Entry) bool {
+	if e.Status != StateInProgress || !b.tryLockKey(e.key()) {
+		return false
+	}
+	b.unlockKey(e.key())
+	return true
+}
+
 // ensureFile ensures that the backend file exists
 func (b *backend) ensureFile() error {
 	file, err := os.OpenFile(b.filePath, os.O_RDONLY|os.O_CREATE, filePerm)
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeBackendFile(t *testing.T) {
+	if step := os.Getenv("CACHESERVER_TEST_MERGE_STEP"); step != "" {
+		mergeStep(t, step, os.Getenv("CACHESERVER_TEST_MERGE_DIR"))
+		return
+	}
+	assert := assert.New(t)
+	nosave = false
+	c, b, clean := newTestCache(t, nil)
+	defer clean()
+	// the steps of the other process run in a child process of the test binary
+	run := func(step string) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestMergeBackendFile$")
+		cmd.Env = append(os.Environ(),
+			"CACHESERVER_TEST_MERGE_STEP="+step,
+			"CACHESERVER_TEST_MERGE_DIR="+filepath.Dir(c.BackendFile),
+		)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(err, string(out))
+	}
+
+	// entries added by one process are loaded by the other
+	foo := addTestEntry(t, b, "/foo", []byte("foo"), time.Now())
+	run("add")
+	assert.NoError(b.sync())
+	assert.Len(b.data, 2)
+	_, e := b.findEntry("/bar", url.Values{})
+	assert.NotNil(e)
+
+	// changes of both processes are kept
+	b.m.Lock()
+	b.data[foo].Size = 42
+	assert.NoError(b.save())
+	b.m.Unlock()
+	run("drop")
+	assert.NoError(b.sync())
+	assert.Len(b.data, 1)
+	assert.Equal(int64(42), b.data[foo].Size)
+
+	// changes of this process win from changes of another process to the same entry
+	b.data[foo].Size = 1
+	run("resize")
+	assert.NoError(b.sync())
+	assert.Equal(int64(1), b.data[foo].Size)
+}
+
+// mergeStep runs a step of the other process of TestMergeBackendFile
+func mergeStep(t *testing.T, step, dir string) {
+	assert := assert.New(t)
+	b, err := openBackend(&Config{
+		BackendFile: path.Join(dir, "backend.data"),
+		CacheDir:    path.Join(dir, "cache"),
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	defer b.lock.close()
+	assert.True(b.shared)
+
+	switch step {
+	case "add":
+		addTestEntry(t, b, "/bar", []byte("bar"), time.Now())
+	case "drop":
+		_, foo := b.findEntry("/foo", url.Values{})
+		assert.Equal(int64(42), foo.Size)
+		bar, _ := b.findEntry("/bar", url.Values{})
+		assert.NoError(b.dropEntry(bar))
+	case "resize":
+		id, foo := b.findEntry("/foo", url.Values{})
+		foo.Size = 2
+		assert.NoError(b.setEntryState(id, StateCached))
+	}
+}
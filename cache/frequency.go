@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sketchDepth = 4
+	sketchWidth = 1 << 16
+)
+
+// FrequencyRule represents a rule where a request is only cached
+// once it has been requested an amount of times within a time window
+type FrequencyRule struct {
+	// MinRequests represents the amount of requests within the window before a request is cached
+	MinRequests int `json:"min_requests"`
+	// Window represents the time window in which requests are counted
+	Window JSONDuration `json:"window"`
+}
+
+// validate checks if the rule is usable
+func (r *FrequencyRule) validate() error {
+	if r.MinRequests < 1 {
+		return errors.New("minimum amount of requests should be at least 1")
+	}
+	if r.Window <= 0 {
+		return errors.New("window should be provided")
+	}
+
+	return nil
+}
+
+// newFrequencySketches returns a sketch for every route with a frequency rule
+// Sketches of previous routes with the same name and rule are kept, so their counts are not lost
+func newFrequencySketches(routes []*Route, previous map[*Route]*frequencySketch) map[*Route]*frequencySketch {
+	sketches := map[*Route]*frequencySketch{}
+	for _, r := range routes {
+		if r.Frequency == nil {
+			continue
+		}
+		sketches[r] = newFrequencySketch(r.Frequency.Window.Duration())
+		for old, s := range previous {
+			if old.Name == r.Name && *old.Frequency == *r.Frequency {
+				sketches[r] = s
+				break
+			}
+		}
+	}
+
+	return sketches
+}
+
+func newFrequencySketch(window time.Duration) *frequencySketch {
+	s := &frequencySketch{
+		window: window,
+		m:      &sync.Mutex{},
+	}
+	s.reset()
+
+	return s
+}
+
+// frequencySketch is a count-min sketch that estimates how many times a key was counted in the current window
+// Estimates can be higher than the real count, but never lower
+type frequencySketch struct {
+	counters    [sketchDepth][]uint32
+	window      time.Duration
+	windowStart time.Time
+	m           *sync.Mutex
+}
+
+// reset clears all counters and starts a new window
+// Make sure to execute this when the sketch is locked
+func (s *frequencySketch) reset() {
+	for i := range s.counters {
+		s.counters[i] = make([]uint32, sketchWidth)
+	}
+	s.windowStart = time.Now()
+}
+
+// increment counts the key and returns the estimated count of the key in the current window
+func (s *frequencySketch) increment(key string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if time.Since(s.windowStart) >= s.window {
+		s.reset()
+	}
+
+	h1, h2 := sketchHashes(key)
+	var estimate uint32
+	for i := range s.counters {
+		idx := (h1 + uint64(i)*h2) % sketchWidth
+		if s.counters[i][idx] < ^uint32(0) {
+			s.counters[i][idx]++
+		}
+		if i == 0 || s.counters[i][idx] < estimate {
+			estimate = s.counters[i][idx]
+		}
+	}
+
+	return int(estimate)
+}
+
+// sketchHashes returns the two hashes of a key used to derive the counter index of each row
+func sketchHashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h.Write([]byte{0})
+	h2 := h.Sum64() | 1
+
+	return h1, h2
+}
+
+// admitFrequency counts a request for an uncached entry
+// and checks if it was requested often enough to be cached according to its route
+func (b *backend) admitFrequency(route *Route, key string) bool {
+	if route == nil || route.Frequency == nil {
+		return true
+	}
+	b.settingsM.RLock()
+	s, ok := b.sketches[route]
+	b.settingsM.RUnlock()
+	if !ok {
+		return true
+	}
+
+	return s.increment(key) >= route.Frequency.MinRequests
+}
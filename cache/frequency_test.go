@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrequencySketch(t *testing.T) {
+	assert := assert.New(t)
+	s := newFrequencySketch(time.Hour)
+
+	for i := 1; i <= 3; i++ {
+		assert.Equal(i, s.increment("/foo"))
+	}
+	// other keys are counted separately
+	for i := 0; i < 1000; i++ {
+		s.increment(fmt.Sprintf("/bar/%d", i))
+	}
+	assert.Equal(4, s.increment("/foo"))
+
+	// counts are reset when the window has passed
+	s.windowStart = time.Now().Add(-2 * time.Hour)
+	assert.Equal(1, s.increment("/foo"))
+}
+
+func TestAdmitFrequency(t *testing.T) {
+	assert := assert.New(t)
+	route := &Route{}
+	err := json.Unmarshal([]byte(`{"prefix": "/", "frequency": {"min_requests": 2, "window": "1h"}}`), route)
+	assert.NoError(err)
+	assert.NoError(route.validate())
+	assert.Equal(time.Hour, route.Frequency.Window.Duration())
+
+	b := &backend{
+		sketches: map[*Route]*frequencySketch{
+			route: newFrequencySketch(route.Frequency.Window.Duration()),
+		},
+	}
+	assert.False(b.admitFrequency(route, "/foo"))
+	assert.True(b.admitFrequency(route, "/foo"))
+	assert.False(b.admitFrequency(route, "/bar"))
+	assert.True(b.admitFrequency(nil, "/bar"))
+}
+
+func TestReconfigure(t *testing.T) {
+	assert := assert.New(t)
+	route := &Route{Name: "foo", Prefix: "/foo", Frequency: &FrequencyRule{MinRequests: 2, Window: JSONDuration(time.Hour)}}
+	b := &backend{}
+	b.reconfigure([]*Route{route}, time.Hour)
+	assert.False(b.admitFrequency(b.route("/foo/a"), "/foo/a"))
+	assert.Equal(time.Hour, b.expiration())
+
+	// counts of an unchanged rule are kept
+	same := *route
+	b.reconfigure([]*Route{&same, {Name: "bar", Prefix: "/bar"}}, time.Minute)
+	assert.True(b.admitFrequency(b.route("/foo/a"), "/foo/a"))
+	assert.Equal("bar", b.route("/bar/a").Name)
+	assert.Equal(time.Minute, b.expiration())
+
+	// counts of a changed rule are reset
+	changed := *route
+	changed.Frequency = &FrequencyRule{MinRequests: 2, Window: JSONDuration(time.Minute)}
+	b.reconfigure([]*Route{&changed}, time.Minute)
+	assert.False(b.admitFrequency(b.route("/foo/a"), "/foo/a"))
+	assert.Nil(b.route("/bar/a"))
+}
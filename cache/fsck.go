@@ -0,0 +1,259 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of inconsistencies found by Fsck
+const (
+	// FsckDangling represents a cached entry of which the cache file is missing
+	FsckDangling = "dangling"
+	// FsckStuck represents an entry that is still being cached, which never finishes when the server is stopped
+	FsckStuck = "stuck"
+	// FsckOrphan represents a file in a cache volume that no entry references
+	FsckOrphan = "orphan"
+	// FsckCorrupt represents a cache file that can not be read
+	FsckCorrupt = "corrupt"
+	// FsckSize represents a cache file of which the size does not match its entry
+	FsckSize = "size"
+)
+
+// Actions on orphan files when repairing
+const (
+	// OrphanKeep leaves orphan files in place
+	OrphanKeep = "keep"
+	// OrphanAdopt moves orphan files to the lost+found directory next to the backend file
+	OrphanAdopt = "adopt"
+	// OrphanDelete deletes orphan files
+	OrphanDelete = "delete"
+)
+
+// FsckOptions represents the checks and repairs of Fsck
+type FsckOptions struct {
+	// Fix repairs the inconsistencies, dangling, stuck and corrupt entries are dropped
+	Fix bool
+	// Orphans represents the action on orphan files when repairing (keep, adopt or delete)
+	Orphans string
+	// Rehash reads every cache file in full to check it can be decrypted and decompressed and has the size of its entry
+	Rehash bool
+}
+
+// FsckIssue represents an inconsistency between the backend file and the cache volumes
+type FsckIssue struct {
+	Kind   string `json:"kind"`
+	ID     string `json:"id,omitempty"`
+	Path   string `json:"path,omitempty"`
+	File   string `json:"file,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	Fixed  bool   `json:"fixed"`
+}
+
+// FsckReport represents the result of Fsck
+type FsckReport struct {
+	Entries int          `json:"entries"`
+	Files   int          `json:"files"`
+	Issues  []*FsckIssue `json:"issues"`
+}
+
+// Unfixed returns the amount of issues that were not repaired
+func (r *FsckReport) Unfixed() int {
+	unfixed := 0
+	for _, i := range r.Issues {
+		if !i.Fixed {
+			unfixed++
+		}
+	}
+	return unfixed
+}
+
+// LostFoundDir returns the directory orphan files of a cache are adopted to
+func LostFoundDir(c *Config) string {
+	return c.BackendFile + ".lost+found"
+}
+
+// Fsck checks the consistency of the backend file and cache volumes of a stopped server
+// and repairs the inconsistencies if requested
+func Fsck(c *Config, opts FsckOptions) (*FsckReport, error) {
+	switch opts.Orphans {
+	case "":
+		opts.Orphans = OrphanKeep
+	case OrphanKeep, OrphanAdopt, OrphanDelete:
+	default:
+		return nil, errors.Errorf("invalid orphan action %s", opts.Orphans)
+	}
+	// the backend file and cache volumes are not used by other processes until fsck returns
+	b, err := openExclusiveBackend(c)
+	if err != nil {
+		return nil, err
+	}
+	defer b.release()
+
+	report := &FsckReport{Entries: len(b.data)}
+	changed := false
+	filesInUse := map[string]bool{}
+	for id, e := range b.entries() {
+		issue := b.fsckEntry(id, e, opts.Rehash)
+		if issue == nil {
+			if e.CachedFile != "" {
+				filesInUse[filepath.Clean(e.CachedFile)] = true
+			}
+			continue
+		}
+		report.Issues = append(report.Issues, issue)
+		if !opts.Fix || issue.Kind == FsckSize {
+			if e.CachedFile != "" {
+				filesInUse[filepath.Clean(e.CachedFile)] = true
+			}
+		}
+		if !opts.Fix {
+			continue
+		}
+
+		issue.Fixed = true
+		changed = true
+		if issue.Kind == FsckSize {
+			// the size of the entry is updated by fsckEntry
+			continue
+		}
+		delete(b.data, id)
+		if e.CachedFile != "" && fileExists(e.CachedFile) {
+			err := os.Remove(e.CachedFile)
+			if err != nil {
+				issue.Detail += ", failed to delete cache file: " + err.Error()
+			}
+		}
+	}
+
+	for _, v := range b.volumes {
+		if !v.isAvailable() {
+			continue
+		}
+		err := walkFiles(v.Dir, func(file string, info os.FileInfo) {
+			report.Files++
+			if filesInUse[file] || b.isMetadataFile(file) {
+				return
+			}
+			issue := &FsckIssue{Kind: FsckOrphan, File: file}
+			report.Issues = append(report.Issues, issue)
+			if opts.Fix {
+				b.fixOrphan(c, issue, opts.Orphans)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if changed {
+		b.m.Lock()
+		err = b.save()
+		b.m.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// fsckEntry checks an entry, returns nil if it is consistent
+func (b *backend) fsckEntry(id string, e *Entry, rehash bool) *FsckIssue {
+	issue := &FsckIssue{ID: id, Path: e.Path, File: e.CachedFile}
+	switch e.Status {
+	case StateNoCache:
+		return nil
+	case StateCached:
+	default:
+		issue.Kind = FsckStuck
+		issue.Detail = "entry is " + string(e.Status)
+		return issue
+	}
+
+	v := b.findVolume(e.Volume)
+	if v == nil || !v.isAvailable() {
+		issue.Kind = FsckDangling
+		issue.Detail = "cache volume " + e.Volume + " is not available"
+		return issue
+	}
+	if !fileExists(e.CachedFile) {
+		issue.Kind = FsckDangling
+		issue.Detail = "cache file is missing"
+		return issue
+	}
+	if !rehash {
+		return nil
+	}
+
+	size, err := b.readCacheFileSize(e)
+	if err != nil {
+		issue.Kind = FsckCorrupt
+		issue.Detail = err.Error()
+		return issue
+	}
+	if size != e.Size {
+		issue.Kind = FsckSize
+		issue.Detail = "entry size does not match cache file"
+		e.Size = size
+		return issue
+	}
+
+	return nil
+}
+
+// readCacheFileSize reads the full cache file of an entry and returns its uncompressed size
+func (b *backend) readCacheFileSize(e *Entry) (int64, error) {
+	body, closer, err := b.openCacheFile(e)
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+	r := io.Reader(body)
+	if e.Encoding != "" {
+		dec, err := newDecoder(body, e.Encoding)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to decompress cache file")
+		}
+		defer dec.Close()
+		r = dec
+	}
+
+	return io.Copy(ioutil.Discard, r)
+}
+
+// isMetadataFile checks if file is the backend file or one of its backups, in case they are stored in a cache volume
+func (b *backend) isMetadataFile(file string) bool {
+	backendFile := filepath.Clean(b.filePath)
+	return file == backendFile || strings.HasPrefix(file, backendFile+".")
+}
+
+// fixOrphan deletes or adopts an orphan file
+func (b *backend) fixOrphan(c *Config, issue *FsckIssue, action string) {
+	var err error
+	switch action {
+	case OrphanKeep:
+		return
+	case OrphanDelete:
+		err = os.Remove(issue.File)
+	case OrphanAdopt:
+		dir := LostFoundDir(c)
+		err = os.MkdirAll(dir, dirPerm)
+		if err == nil {
+			target := filepath.Join(dir, filepath.Base(issue.File))
+			err = os.Rename(issue.File, target)
+			issue.Detail = "adopted as " + target
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to %s orphan file %s: %s", action, issue.File, err)
+		issue.Detail = err.Error()
+		return
+	}
+	issue.Fixed = true
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsck(t *testing.T) {
+	assert := assert.New(t)
+	nosave = false
+	c, b, clean := newTestCache(t, nil)
+	defer clean()
+	addTestEntry(t, b, "/ok", []byte("ok"), time.Now())
+	dangling := addTestEntry(t, b, "/dangling", []byte("dangling"), time.Now())
+	assert.NoError(os.Remove(b.data[dangling].CachedFile))
+	corrupt := addTestEntry(t, b, "/corrupt", []byte("corrupt"), time.Now())
+	assert.NoError(ioutil.WriteFile(b.data[corrupt].CachedFile, []byte("not gzip"), filePerm))
+	stuck := addTestEntry(t, b, "/stuck", []byte("stuck"), time.Now())
+	b.data[stuck].Status = StateInProgress
+	assert.NoError(b.save())
+	orphan := path.Join(b.volumes[0].Dir, "orphan.blob")
+	assert.NoError(ioutil.WriteFile(orphan, []byte("orphan"), filePerm))
+
+	report, err := Fsck(c, FsckOptions{Rehash: true})
+	assert.NoError(err)
+	assert.Equal(4, report.Entries)
+	assert.Equal(4, report.Files)
+	kinds := map[string]string{}
+	for _, i := range report.Issues {
+		kinds[i.Kind] = i.ID
+		assert.False(i.Fixed)
+	}
+	assert.Equal(map[string]string{
+		FsckDangling: dangling,
+		FsckCorrupt:  corrupt,
+		FsckStuck:    stuck,
+		FsckOrphan:   "",
+	}, kinds)
+
+	report, err = Fsck(c, FsckOptions{Fix: true, Orphans: OrphanAdopt, Rehash: true})
+	assert.NoError(err)
+	assert.Len(report.Issues, 4)
+	assert.Equal(0, report.Unfixed())
+	assert.False(fileExists(orphan))
+	assert.True(fileExists(path.Join(LostFoundDir(c), "orphan.blob")))
+
+	report, err = Fsck(c, FsckOptions{Rehash: true})
+	assert.NoError(err)
+	assert.Equal(1, report.Entries)
+	assert.Equal(1, report.Files)
+	assert.Empty(report.Issues)
+}
+
+func TestFsckExclusive(t *testing.T) {
+	assert := assert.New(t)
+	nosave = false
+	c, b, clean := newTestCache(t, nil)
+	defer clean()
+
+	// missing cache volumes are not created
+	missing := path.Join(path.Dir(c.BackendFile), "missing")
+	c.Volumes = []*Volume{{Dir: c.CacheDir}, {Dir: missing}}
+	_, err := Fsck(c, FsckOptions{})
+	assert.NoError(err)
+	_, err = os.Stat(missing)
+	assert.True(os.IsNotExist(err))
+
+	// the backend file can not be read until the exclusive backend is released
+	fb, err := openExclusiveBackend(c)
+	assert.NoError(err)
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := b.lockMetadata(false)
+		assert.NoError(err)
+		close(locked)
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Error("backend file was locked while an exclusive backend holds it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(fb.release())
+	<-locked
+}
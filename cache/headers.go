@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// CacheName represents the name the cache identifies itself with in the Via and Cache-Status headers
+	CacheName = "cacheserver"
+	// DebugHeader represents the request header that adds the cache key and entry ID to the response
+	DebugHeader = "X-Cache-Debug"
+	// KeyHeader represents the response header with the cache key of a debug request
+	KeyHeader = "X-Cache-Key"
+	// EntryHeader represents the response header with the cache entry ID of a debug request
+	EntryHeader = "X-Cache-Entry"
+)
+
+// setCacheHeaders sets the headers that tell the client how the cache served a request
+// e is the entry the response is served from, nil if the request was proxied without an entry
+func (b *backend) setCacheHeaders(res http.ResponseWriter, req *http.Request, outcome Outcome, id string, e *Entry) {
+	h := res.Header()
+	status := []string{}
+	switch outcome {
+	case OutcomeHit:
+		h.Set("X-Cache", "HIT")
+		status = append(status, "hit")
+	case OutcomeStale:
+		h.Set("X-Cache", "STALE")
+		status = append(status, "hit")
+	case OutcomeCoalesced:
+		h.Set("X-Cache", "HIT")
+		status = append(status, "fwd=uri-miss", "collapsed")
+	case OutcomeMiss:
+		h.Set("X-Cache", "MISS")
+		status = append(status, "fwd=uri-miss", "stored")
+	default:
+		h.Set("X-Cache", "BYPASS")
+		status = append(status, bypassReason(req))
+	}
+	if e != nil {
+		e.m.Lock()
+		age := time.Since(e.InitTime.Time())
+		code := 0
+		if e.resp != nil {
+			code = e.resp.responseCode
+		}
+		e.m.Unlock()
+		if age < 0 {
+			age = 0
+		}
+		if code != 0 && outcome != OutcomeHit {
+			status = append(status, "fwd-status="+strconv.Itoa(code))
+		}
+		seconds := int(age / time.Second)
+		if expiration := b.expiration(); expiration > 0 {
+			status = append(status, "ttl="+strconv.Itoa(int(expiration/time.Second)-seconds))
+		}
+		h.Set("Age", strconv.Itoa(seconds))
+	}
+	if b.isOffline() {
+		status = append(status, "detail=offline")
+	}
+	setStatusHeaders(h, req, status, id)
+}
+
+// SetBypassHeaders sets the headers that tell the client a request was proxied without caching it
+func SetBypassHeaders(res http.ResponseWriter, req *http.Request) {
+	h := res.Header()
+	h.Set("X-Cache", "BYPASS")
+	setStatusHeaders(h, req, []string{bypassReason(req)}, "")
+}
+
+// bypassReason returns the Cache-Status forward reason of a request that is not cached
+func bypassReason(req *http.Request) string {
+	if req.Method != http.MethodGet {
+		return "fwd=method"
+	}
+	return "fwd=bypass"
+}
+
+// setStatusHeaders sets the Cache-Status and Via headers and the debug headers if the request asks for them
+func setStatusHeaders(h http.Header, req *http.Request, status []string, id string) {
+	key := req.URL.Path + "?" + req.URL.Query().Encode()
+	debug := req.Header.Get(DebugHeader) != ""
+	if debug {
+		status = append(status, "key="+strconv.Quote(key))
+	}
+	value := CacheName
+	for _, s := range status {
+		value += "; " + s
+	}
+	// caches closer to the client are listed after the proxy target
+	h.Add("Cache-Status", value)
+	h.Add("Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, CacheName))
+
+	if debug {
+		h.Set(KeyHeader, key)
+		if id != "" {
+			h.Set(EntryHeader, id)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheHeaders(t *testing.T) {
+	assert := assert.New(t)
+	nosave = false
+	_, b, clean := newTestCache(t, nil)
+	defer clean()
+	b.cacheExpiration = time.Hour
+	id := addTestEntry(t, b, "/foo", []byte("foo"), time.Now().Add(-10*time.Minute))
+
+	req := httptest.NewRequest("GET", "/foo", nil)
+	res := httptest.NewRecorder()
+	assert.NoError(b.entryCached(id, res, req))
+	assert.Equal("foo", res.Body.String())
+	assert.Equal("HIT", res.Header().Get("X-Cache"))
+	assert.Equal("cacheserver; hit; ttl=3000", res.Header().Get("Cache-Status"))
+	assert.Equal("600", res.Header().Get("Age"))
+	assert.Equal("1.1 cacheserver", res.Header().Get("Via"))
+	assert.Empty(res.Header().Get(KeyHeader))
+
+	// debug requests get the cache key and entry ID
+	req.Header.Set(DebugHeader, "1")
+	res = httptest.NewRecorder()
+	assert.NoError(b.entryCached(id, res, req))
+	assert.Equal(`cacheserver; hit; ttl=3000; key="/foo?"`, res.Header().Get("Cache-Status"))
+	assert.Equal("/foo?", res.Header().Get(KeyHeader))
+	assert.Equal(id, res.Header().Get(EntryHeader))
+
+	// the status of the proxy target is listed before the status of the cache
+	req = httptest.NewRequest("POST", "/foo", nil)
+	res = httptest.NewRecorder()
+	res.Header().Add("Cache-Status", "upstream; hit")
+	SetBypassHeaders(res, req)
+	assert.Equal("BYPASS", res.Header().Get("X-Cache"))
+	assert.Equal([]string{"upstream; hit", "cacheserver; fwd=method"}, res.Header().Values("Cache-Status"))
+	assert.Empty(res.Header().Get("Age"))
+}
@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CheckStorage checks if cache files can be written to at least one cache volume
+func (c *Cache) CheckStorage() error {
+	failed := []string{}
+	for _, v := range c.b.volumes {
+		err := v.checkWritable()
+		if err == nil {
+			return nil
+		}
+		failed = append(failed, err.Error())
+	}
+
+	return errors.Errorf("no cache volume is writable: %s", strings.Join(failed, ", "))
+}
+
+// CheckMetadata checks if the backend file can be read
+func (c *Cache) CheckMetadata() error {
+	return c.b.sync()
+}
+
+// checkWritable checks if a file can be created in the volume directory
+func (v *volume) checkWritable() error {
+	if !v.isAvailable() {
+		return errors.Errorf("%s is not available", v.Dir)
+	}
+	f, err := createAtomic(path.Join(v.Dir, ".writable"))
+	if err != nil {
+		return errors.Wrapf(err, "%s is not writable", v.Dir)
+	}
+	f.abort()
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package cache
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckStorage(t *testing.T) {
+	assert := assert.New(t)
+	volumes, clean := newTestVolumes(t, 2)
+	defer clean()
+	c := &Cache{b: &backend{volumes: volumes}}
+	assert.NoError(c.CheckStorage())
+
+	// the writability check leaves no files behind
+	files, err := ioutil.ReadDir(volumes[0].Dir)
+	assert.NoError(err)
+	assert.Empty(files)
+
+	volumes[0].available = false
+	assert.NoError(c.CheckStorage())
+	volumes[1].available = false
+	assert.Error(c.CheckStorage())
+}
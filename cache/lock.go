@@ -0,0 +1,269 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Processes sharing a backend file coordinate with locks on single bytes of the lock file next to it:
+// the metadata byte is locked while the backend file is read or written,
+// every process holds a shared lock on the process byte while it uses the cache,
+// and the byte of a request key is locked while the key is downloaded.
+const (
+	lockFileSuffix      = ".lock"
+	metadataLockOffset  = 0
+	processLockOffset   = 1
+	keyLockOffset       = 1 << 32
+	keyLockPollInterval = 100 * time.Millisecond
+	orphanGracePeriod   = 10 * time.Minute
+)
+
+var (
+	// ErrCacheInUse represents an error where the cache is used by another process
+	ErrCacheInUse = errors.New("cache is in use by another process")
+)
+
+var (
+	// lock files opened by this process, closing any descriptor of a lock file releases all locks of the process on it
+	lockFiles  = map[string]*fileLock{}
+	lockFilesM sync.Mutex
+)
+
+// fileLock represents the lock file of a backend file
+// Locks are held by the process, so the holders in this process are tracked as well
+type fileLock struct {
+	path    string
+	refs    int // amount of backends of this process using the lock file
+	f       *os.File
+	m       sync.Mutex
+	keys    map[int64]int // amount of holders of key locks in this process
+	meta    sync.RWMutex  // excludes holders of the metadata lock in this process
+	metaM   sync.Mutex
+	readers int // amount of holders of the shared metadata lock in this process
+}
+
+// openFileLock opens the lock file of a backend file
+// Backends of the same backend file in this process share the lock file
+func openFileLock(backendFile string) (*fileLock, error) {
+	path, err := filepath.Abs(backendFile + lockFileSuffix)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open lock file")
+	}
+	lockFilesM.Lock()
+	defer lockFilesM.Unlock()
+	if l, ok := lockFiles[path]; ok {
+		l.refs++
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open lock file")
+	}
+	l := &fileLock{
+		path: path,
+		refs: 1,
+		f:    f,
+		keys: map[int64]int{},
+	}
+	lockFiles[path] = l
+
+	return l, nil
+}
+
+// close closes the lock file once no backend of this process uses it, which releases all locks of the process
+func (l *fileLock) close() error {
+	lockFilesM.Lock()
+	defer lockFilesM.Unlock()
+	l.refs--
+	if l.refs > 0 {
+		return nil
+	}
+	delete(lockFiles, l.path)
+	return l.f.Close()
+}
+
+// lockMetadata locks the metadata byte, exclusive for writing and shared for reading
+// The shared lock of the process is only released once every reader in this process released it
+func (l *fileLock) lockMetadata(exclusive bool) (func(), error) {
+	if exclusive {
+		l.meta.Lock()
+		_, err := l.lockRange(metadataLockOffset, true, true)
+		if err != nil {
+			l.meta.Unlock()
+			return nil, err
+		}
+		return func() {
+			l.unlockRange(metadataLockOffset)
+			l.meta.Unlock()
+		}, nil
+	}
+
+	l.meta.RLock()
+	l.metaM.Lock()
+	defer l.metaM.Unlock()
+	if l.readers == 0 {
+		_, err := l.lockRange(metadataLockOffset, false, true)
+		if err != nil {
+			l.meta.RUnlock()
+			return nil, err
+		}
+	}
+	l.readers++
+	return func() {
+		l.metaM.Lock()
+		l.readers--
+		if l.readers == 0 {
+			l.unlockRange(metadataLockOffset)
+		}
+		l.metaM.Unlock()
+		l.meta.RUnlock()
+	}, nil
+}
+
+// tryLockKey locks the byte of a key without waiting
+// Locks of a process do not exclude each other, so key locks are counted
+// and only released once every holder in this process released it
+func (l *fileLock) tryLockKey(offset int64) (bool, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.keys[offset] > 0 {
+		l.keys[offset]++
+		return true, nil
+	}
+	ok, err := l.lockRange(offset, true, false)
+	if ok {
+		l.keys[offset] = 1
+	}
+	return ok, err
+}
+
+// unlockKey releases the byte of a key
+func (l *fileLock) unlockKey(offset int64) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.keys[offset]--
+	if l.keys[offset] > 0 {
+		return
+	}
+	delete(l.keys, offset)
+	l.unlockRange(offset)
+}
+
+// keyOffset returns the byte of the lock file that is locked while a request key is downloaded
+func keyOffset(key string) int64 {
+	sum := sha256.Sum256([]byte(key))
+	return keyLockOffset + int64(binary.BigEndian.Uint64(sum[:])>>3)
+}
+
+// lockMetadata locks the backend file, exclusive for writing and shared for reading
+// Returns the function that releases the lock
+// A backend that is exclusive already holds the lock
+func (b *backend) lockMetadata(exclusive bool) (func(), error) {
+	if b.lock == nil || b.exclusive != nil {
+		return func() {}, nil
+	}
+	unlock, err := b.lock.lockMetadata(exclusive)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lock backend file")
+	}
+
+	return unlock, nil
+}
+
+// registerProcess marks the cache as used by this process
+// Returns true if no other process is using the cache
+func (b *backend) registerProcess() (bool, error) {
+	if b.lock == nil {
+		return true, nil
+	}
+	sole, err := b.lock.lockRange(processLockOffset, true, false)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to lock cache")
+	}
+	// converting the exclusive lock to a shared lock is atomic
+	_, err = b.lock.lockRange(processLockOffset, false, true)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to lock cache")
+	}
+
+	return sole, nil
+}
+
+// lockExclusive locks the cache and the backend file for this process alone until the backend is released
+// Returns ErrCacheInUse if another process uses the cache
+func (b *backend) lockExclusive() error {
+	sole, err := b.lock.lockRange(processLockOffset, true, false)
+	if err != nil {
+		return errors.Wrap(err, "failed to lock cache")
+	}
+	if !sole {
+		return ErrCacheInUse
+	}
+	unlock, err := b.lock.lockMetadata(true)
+	if err != nil {
+		b.lock.lockRange(processLockOffset, false, true)
+		return errors.Wrap(err, "failed to lock backend file")
+	}
+	b.exclusive = func() {
+		unlock()
+		// other backends of this process keep using the cache
+		b.lock.lockRange(processLockOffset, false, true)
+	}
+
+	return nil
+}
+
+// release releases the locks of an exclusive backend and closes its lock file
+func (b *backend) release() error {
+	if b.exclusive != nil {
+		b.exclusive()
+		b.exclusive = nil
+	}
+	return b.lock.close()
+}
+
+// lockKey locks a request key so it is only downloaded by one process at a time
+// Waits until the lock is acquired or the context is done
+func (b *backend) lockKey(ctx context.Context, key string) error {
+	if b.lock == nil {
+		return nil
+	}
+	for {
+		ok, err := b.lock.tryLockKey(keyOffset(key))
+		if err != nil {
+			return errors.Wrap(err, "failed to lock download")
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(keyLockPollInterval):
+		}
+	}
+}
+
+// tryLockKey locks a request key if it is not being downloaded by another process
+func (b *backend) tryLockKey(key string) bool {
+	if b.lock == nil {
+		return true
+	}
+	ok, err := b.lock.tryLockKey(keyOffset(key))
+	return err == nil && ok
+}
+
+// unlockKey releases the lock of a request key
+func (b *backend) unlockKey(key string) {
+	if b.lock == nil {
+		return
+	}
+	b.lock.unlockKey(keyOffset(key))
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+package cache
+
+import (
+	"syscall"
+)
+
+// lockRange places a lock on one byte of the lock file with fcntl
+// Returns false if wait is not set and the byte is locked by another process
+func (l *fileLock) lockRange(offset int64, exclusive, wait bool) (bool, error) {
+	lk := &syscall.Flock_t{
+		Type:   syscall.F_RDLCK,
+		Whence: 0,
+		Start:  offset,
+		Len:    1,
+	}
+	if exclusive {
+		lk.Type = syscall.F_WRLCK
+	}
+	cmd := syscall.F_SETLK
+	if wait {
+		cmd = syscall.F_SETLKW
+	}
+	for {
+		err := syscall.FcntlFlock(l.f.Fd(), cmd, lk)
+		switch err {
+		case nil:
+			return true, nil
+		case syscall.EINTR:
+			continue
+		case syscall.EAGAIN, syscall.EACCES:
+			if !wait {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+}
+
+// unlockRange releases the lock on one byte of the lock file
+func (l *fileLock) unlockRange(offset int64) error {
+	return syscall.FcntlFlock(l.f.Fd(), syscall.F_SETLK, &syscall.Flock_t{
+		Type:   syscall.F_UNLCK,
+		Whence: 0,
+		Start:  offset,
+		Len:    1,
+	})
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// MemoryConfig represents the configuration of the in memory cache tier
+// Small entries that are requested often are held in memory so they are not read from disk on every request
+type MemoryConfig struct {
+	// MaxSize represents the maximum amount of bytes held in memory (0 disables the memory tier)
+	MaxSize int64 `yaml:"max_size"`
+	// MaxObjectSize represents the maximum body size of an entry held in memory
+	MaxObjectSize int64 `yaml:"max_object_size"`
+	// MinHits represents the amount of cache hits an entry needs before it is held in memory
+	MinHits int `yaml:"min_hits"`
+}
+
+func newMemoryTier(c MemoryConfig) *memoryTier {
+	if c.MaxSize <= 0 {
+		return nil
+	}
+	if c.MaxObjectSize <= 0 || c.MaxObjectSize > c.MaxSize {
+		c.MaxObjectSize = c.MaxSize
+	}
+
+	return &memoryTier{
+		c:     c,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// memoryTier is a size bounded least recently used cache of entry bodies
+type memoryTier struct {
+	c     MemoryConfig
+	m     sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type memoryItem struct {
+	id   string
+	file string // cache file the body was read from
+	data []byte
+}
+
+// admissible checks if an entry of provided size and hit count can be held in memory
+func (t *memoryTier) admissible(size int64, hits int) bool {
+	return size <= t.c.MaxObjectSize && hits >= t.c.MinHits
+}
+
+// get returns the body of an entry if it is held in memory
+// file is the current cache file of the entry, bodies read from another cache file are not returned
+func (t *memoryTier) get(id, file string) ([]byte, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	el, ok := t.items[id]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*memoryItem)
+	if item.file != file {
+		t.removeElement(el)
+		return nil, false
+	}
+	t.lru.MoveToFront(el)
+
+	return item.data, true
+}
+
+// add holds the body of an entry in memory, evicting the least recently used entries if needed
+func (t *memoryTier) add(id, file string, data []byte) {
+	size := int64(len(data))
+	if size > t.c.MaxObjectSize {
+		return
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	if el, ok := t.items[id]; ok {
+		t.removeElement(el)
+	}
+	for t.size+size > t.c.MaxSize {
+		t.removeElement(t.lru.Back())
+	}
+	t.items[id] = t.lru.PushFront(&memoryItem{
+		id:   id,
+		file: file,
+		data: data,
+	})
+	t.size += size
+}
+
+// remove drops an entry from memory
+func (t *memoryTier) remove(id string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if el, ok := t.items[id]; ok {
+		t.removeElement(el)
+	}
+}
+
+// stats returns the amount of entries and bytes held in memory
+func (t *memoryTier) stats() (int, int64) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return len(t.items), t.size
+}
+
+// removeElement drops an element from the tier
+// Make sure to execute this when the tier is locked
+func (t *memoryTier) removeElement(el *list.Element) {
+	item := t.lru.Remove(el).(*memoryItem)
+	delete(t.items, item.id)
+	t.size -= int64(len(item.data))
+}
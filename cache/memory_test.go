@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryTier(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(newMemoryTier(MemoryConfig{}))
+
+	m := newMemoryTier(MemoryConfig{
+		MaxSize:       10,
+		MaxObjectSize: 5,
+		MinHits:       2,
+	})
+	assert.False(m.admissible(3, 1))
+	assert.False(m.admissible(6, 2))
+	assert.True(m.admissible(5, 2))
+
+	m.add("1", "a", []byte("1111"))
+	m.add("2", "b", []byte("2222"))
+	m.add("3", "c", []byte("333333"))
+	assert.Equal(int64(8), m.size)
+
+	// least recently used entry is evicted
+	_, ok := m.get("1", "a")
+	assert.True(ok)
+	m.add("3", "c", []byte("333"))
+	_, ok = m.get("2", "b")
+	assert.False(ok)
+	data, ok := m.get("1", "a")
+	assert.True(ok)
+	assert.Equal([]byte("1111"), data)
+	assert.Equal(int64(7), m.size)
+
+	// bodies of another cache file are not returned
+	_, ok = m.get("3", "d")
+	assert.False(ok)
+	assert.Equal(int64(4), m.size)
+
+	m.remove("1")
+	_, ok = m.get("1", "a")
+	assert.False(ok)
+	assert.Equal(int64(0), m.size)
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// metadataVersion represents the version of the backend file layout written by this version
+// Version 1 is the layout without envelope, a bare JSON map of the entries
+const metadataVersion = 2
+
+var (
+	// ErrMetadataVersion represents an error where the backend file was written by a newer version
+	ErrMetadataVersion = errors.New("backend file was written by a newer version of the cacheserver")
+)
+
+// metadataFile represents the versioned envelope of the backend file
+type metadataFile struct {
+	Version int             `json:"version"`
+	Entries json.RawMessage `json:"entries"`
+}
+
+// rawEntries represents the entries of a backend file as generic JSON objects
+// so migrations can change them without depending on the current Entry type
+type rawEntries map[string]map[string]interface{}
+
+// migration upgrades the entries of a backend file to the next version
+type migration func(entries rawEntries) error
+
+// migrations upgrade the backend file layouts, migrations[i] upgrades version i+1 to version i+2
+// Add a migration and bump metadataVersion when the layout of Entry changes
+var migrations = []migration{
+	migrateV1,
+}
+
+// migrateV1 sets the volume of entries of a run with a single cache dir
+// and renames the misspelled innited key of the init time
+func migrateV1(entries rawEntries) error {
+	for _, e := range entries {
+		if initTime, ok := e["innited"]; ok {
+			e["init_time"] = initTime
+			delete(e, "innited")
+		}
+		if v, _ := e["volume"].(string); v != "" {
+			continue
+		}
+		if file, ok := e["cached_file"].(string); ok && file != "" {
+			e["volume"] = filepath.Dir(file)
+		}
+	}
+
+	return nil
+}
+
+// decodeMetadata returns the version and entries of the backend file data
+func decodeMetadata(data []byte) (int, json.RawMessage, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || string(data) == "[]" {
+		return metadataVersion, nil, nil
+	}
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, ok := fields["version"]; !ok {
+		return 1, data, nil
+	}
+	f := &metadataFile{}
+	err = json.Unmarshal(data, f)
+	if err != nil {
+		return 0, nil, err
+	}
+	if f.Version < 1 {
+		return 0, nil, errors.Errorf("invalid backend file version %d", f.Version)
+	}
+
+	return f.Version, f.Entries, nil
+}
+
+// migrateMetadata upgrades entries of the provided version to the current version
+func migrateMetadata(version int, entries json.RawMessage) (json.RawMessage, error) {
+	if version > metadataVersion {
+		return nil, errors.Wrapf(ErrMetadataVersion, "version %d is not supported, latest supported version is %d", version, metadataVersion)
+	}
+	if version == metadataVersion || len(entries) == 0 {
+		return entries, nil
+	}
+
+	raw := rawEntries{}
+	d := json.NewDecoder(bytes.NewReader(entries))
+	d.UseNumber()
+	err := d.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	for v := version; v < metadataVersion; v++ {
+		log.Infof("Migrating backend file from version %d to %d", v, v+1)
+		err = migrations[v-1](raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to migrate backend file from version %d", v)
+		}
+	}
+
+	return json.Marshal(raw)
+}
+
+// backupFile returns the path of the backup of a backend file of the provided version
+func backupFile(file string, version int) string {
+	return fmt.Sprintf("%s.v%d.bak", file, version)
+}
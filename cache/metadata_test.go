@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateMetadata(t *testing.T) {
+	assert := assert.New(t)
+	nosave = false
+	c, b, clean := newTestCache(t, nil)
+	defer clean()
+	// testdata/backend.v1.data was written by the baseline version with its cache dir in /tmp/v1/cache
+	legacy, err := ioutil.ReadFile("testdata/backend.v1.data")
+	assert.NoError(err)
+	legacy = bytes.Replace(legacy, []byte("/tmp/v1/cache"), []byte(b.volumes[0].Dir), -1)
+	assert.NoError(ioutil.WriteFile(c.BackendFile, legacy, filePerm))
+	const cachedID, initID = "g_pX4j3J1bjPh75J-68149iUI", "XNYPKOEnExioNpM-05PYwbBF4"
+
+	b, err = openBackend(c)
+	assert.NoError(err)
+	assert.Len(b.data, 2)
+	cached := b.data[cachedID]
+	assert.Equal("/foo", cached.Path)
+	assert.Equal(url.Values{"a": {"b"}}, cached.Params)
+	assert.Equal(StateCached, cached.Status)
+	assert.Equal(int64(1792354197), cached.InitTime.Unix())
+	assert.Equal(b.volumes[0].Dir, cached.Volume)
+	assert.Equal(StateInit, b.data[initID].Status)
+	assert.Empty(b.data[initID].Volume)
+	// nothing changes until the backend file is saved
+	assert.False(fileExists(backupFile(c.BackendFile, 1)))
+
+	assert.NoError(b.save())
+	backup, err := ioutil.ReadFile(backupFile(c.BackendFile, 1))
+	assert.NoError(err)
+	assert.Equal(legacy, backup)
+	data, err := ioutil.ReadFile(c.BackendFile)
+	assert.NoError(err)
+	f := &metadataFile{}
+	assert.NoError(json.Unmarshal(data, f))
+	assert.Equal(metadataVersion, f.Version)
+	entries := rawEntries{}
+	assert.NoError(json.Unmarshal(f.Entries, &entries))
+	assert.NotContains(entries[cachedID], "innited")
+	assert.EqualValues(1792354197, entries[cachedID]["init_time"])
+
+	b, err = openBackend(c)
+	assert.NoError(err)
+	assert.Nil(b.backup)
+	assert.Equal(b.volumes[0].Dir, b.data[cachedID].Volume)
+	assert.Equal(int64(1792354197), b.data[cachedID].InitTime.Unix())
+}
+
+func TestNewerMetadataVersion(t *testing.T) {
+	assert := assert.New(t)
+	c, _, clean := newTestCache(t, nil)
+	defer clean()
+	assert.NoError(ioutil.WriteFile(c.BackendFile, []byte(`{"version": 100, "entries": {}}`), filePerm))
+
+	_, err := openBackend(c)
+	assert.Equal(ErrMetadataVersion, errors.Cause(err))
+}
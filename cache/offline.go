@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetOffline switches offline mode on or off
+// In offline mode the proxy target is never contacted: cached entries are served even if they have expired
+// and requests that are not cached get a 504 response
+func (c *Cache) SetOffline(offline bool) {
+	c.b.m.Lock()
+	changed := c.b.offline != offline
+	c.b.offline = offline
+	c.b.m.Unlock()
+	if changed {
+		if offline {
+			log.Warn("Switched to offline mode, only serving requests from the cache")
+		} else {
+			log.Info("Switched to online mode, resuming requests to the proxy target")
+		}
+	}
+}
+
+// Offline checks if the cache is in offline mode
+func (c *Cache) Offline() bool {
+	return c.b.isOffline()
+}
+
+func (b *backend) isOffline() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.offline
+}
+
+// copyOffline serves a request from the cache without contacting the proxy target
+// Entries that are downloaded by this process when the cache went offline are still streamed
+func (b *backend) copyOffline(res http.ResponseWriter, req *http.Request) error {
+	id, err := b.findEntryByRequest(req)
+	if err == ErrEntryNotFound {
+		// another process sharing the cache might have cached the request
+		err = b.sync()
+		if err != nil {
+			log.Errorf("Failed to sync backend file: %s", err)
+		}
+		id, err = b.findEntryByRequest(req)
+	}
+	if err != nil && err != ErrEntryNotFound {
+		return errors.Wrap(err, "failed to search entry")
+	}
+	setRequestEntry(req, b.route(req.URL.Path), id)
+	if err == ErrEntryNotFound {
+		b.writeOfflineMiss(res, req, "")
+		return nil
+	}
+
+	state, err := b.getEntryState(id)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case StateCached:
+		e, ok := b.getEntry(id)
+		if !ok {
+			return ErrEntryNotFound
+		}
+		outcome := OutcomeHit
+		if e.isExpired(b.expiration()) {
+			outcome = OutcomeStale
+		}
+		return b.serveCached(id, e, res, req, outcome)
+	case StateInProgress:
+		if b.downloadingLocally(id) {
+			return b.entryInProgress(id, res, req, OutcomeCoalesced)
+		}
+	}
+	b.writeOfflineMiss(res, req, id)
+
+	return nil
+}
+
+// WriteOfflineMiss writes the response of a request that can not be served in offline mode
+func (c *Cache) WriteOfflineMiss(res http.ResponseWriter, req *http.Request) {
+	c.b.writeOfflineMiss(res, req, "")
+}
+
+func (b *backend) writeOfflineMiss(res http.ResponseWriter, req *http.Request, id string) {
+	h := res.Header()
+	reason := "fwd=uri-miss"
+	if req.Method != http.MethodGet {
+		reason = bypassReason(req)
+		b.setOutcome(req, OutcomeBypass)
+		h.Set("X-Cache", "BYPASS")
+	} else {
+		b.setOutcome(req, OutcomeMiss)
+		h.Set("X-Cache", "MISS")
+	}
+	setStatusHeaders(h, req, []string{reason, "detail=offline"}, id)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(http.StatusGatewayTimeout)
+	fmt.Fprintf(res, "cache miss: %s %s is not cached and the cache is offline\n", req.Method, req.URL.Path)
+}
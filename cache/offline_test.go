@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffline(t *testing.T) {
+	assert := assert.New(t)
+	var requests int32
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		res.Write([]byte("foo"))
+	}))
+	defer target.Close()
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	cache, err := New(&Config{
+		BackendFile:     path.Join(dir, "backend.data"),
+		CacheDir:        path.Join(dir, "cache"),
+		ProxyTarget:     target.URL,
+		CacheExpiration: time.Hour,
+	})
+	assert.NoError(err)
+
+	assert.NoError(cache.CopyFromCache(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil)))
+	assert.Eventually(func() bool {
+		return cache.Stats().States[StateCached] == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.EqualValues(1, atomic.LoadInt32(&requests))
+
+	cache.SetOffline(true)
+	assert.True(cache.Offline())
+
+	res := httptest.NewRecorder()
+	assert.NoError(cache.CopyFromCache(res, httptest.NewRequest("GET", "/foo", nil)))
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal("foo", res.Body.String())
+	assert.Equal("HIT", res.Header().Get("X-Cache"))
+
+	// expired entries are served as is
+	for _, e := range cache.b.entries() {
+		e.m.Lock()
+		e.InitTime = JSONTime(time.Now().Add(-2 * time.Hour))
+		e.m.Unlock()
+	}
+	res = httptest.NewRecorder()
+	assert.NoError(cache.CopyFromCache(res, httptest.NewRequest("GET", "/foo", nil)))
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal("foo", res.Body.String())
+	assert.Equal("STALE", res.Header().Get("X-Cache"))
+	assert.Contains(res.Header().Get("Cache-Status"), "detail=offline")
+
+	res = httptest.NewRecorder()
+	assert.NoError(cache.CopyFromCache(res, httptest.NewRequest("GET", "/bar", nil)))
+	assert.Equal(http.StatusGatewayTimeout, res.Code)
+	assert.Contains(res.Body.String(), "cache miss")
+	assert.Equal("MISS", res.Header().Get("X-Cache"))
+	assert.EqualValues(1, atomic.LoadInt32(&requests))
+
+	cache.SetOffline(false)
+	res = httptest.NewRecorder()
+	assert.NoError(cache.CopyFromCache(res, httptest.NewRequest("GET", "/bar", nil)))
+	assert.Equal(http.StatusOK, res.Code)
+	assert.EqualValues(2, atomic.LoadInt32(&requests))
+	assert.NoError(cache.Close(context.Background()))
+}
@@ -0,0 +1,19 @@
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl request that shares the extents of a file with another file
+const ficlone = 0x40049409
+
+// reflink makes dst a copy on write clone of src
+// This is only supported by some filesystems (eg: btrfs, xfs) and when both files are on the same filesystem
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
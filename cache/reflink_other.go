@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package cache
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// reflink makes dst a copy on write clone of src
+// This is only supported on linux
+func reflink(dst, src *os.File) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+)
+
+// Outcome represents how the cache served a request
+type Outcome string
+
+const (
+	// OutcomeHit represents a request that was served from a cached file
+	OutcomeHit Outcome = "HIT"
+	// OutcomeMiss represents a request that started downloading the entry from the proxy target
+	OutcomeMiss Outcome = "MISS"
+	// OutcomeCoalesced represents a request that was served from the download of another request
+	OutcomeCoalesced Outcome = "COALESCED"
+	// OutcomeStale represents a request that was served from an expired cached file in offline mode
+	OutcomeStale Outcome = "STALE"
+	// OutcomeBypass represents a request that was proxied without caching it
+	OutcomeBypass Outcome = "BYPASS"
+)
+
+// FillSource represents how an entry was stored in the cache
+type FillSource string
+
+const (
+	// FillDownload represents an entry that was downloaded from the proxy target for the first time
+	FillDownload FillSource = "download"
+	// FillRefresh represents an entry that was downloaded again after it expired or was refreshed
+	FillRefresh FillSource = "refresh"
+	// FillSeed represents an entry that was seeded from a local file
+	FillSeed FillSource = "seed"
+	// FillImport represents an entry that was imported from an archive
+	FillImport FillSource = "import"
+)
+
+// RequestInfo represents how the cache served a request
+type RequestInfo struct {
+	// Outcome represents how the request was served
+	Outcome Outcome
+	// Route represents the name of the route of the request (empty if no route matches)
+	Route string
+	// EntryID represents the ID of the cache entry of the request (empty if the request has no entry)
+	EntryID string
+	// Upstream represents the host the request was sent to (empty if the request was not sent upstream)
+	Upstream string
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a copy of the request that records how the cache serves it in info
+func WithRequestInfo(req *http.Request, info *RequestInfo) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+}
+
+// GetRequestInfo returns the RequestInfo how the cache serves a request is recorded in
+// Returns nil if the request was not created with WithRequestInfo
+func GetRequestInfo(req *http.Request) *RequestInfo {
+	info, _ := req.Context().Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// setOutcome records how the cache served a request and reports it
+func (b *backend) setOutcome(req *http.Request, outcome Outcome) {
+	if info := GetRequestInfo(req); info != nil {
+		info.Outcome = outcome
+	}
+	if b.onOutcome != nil {
+		b.onOutcome(b.routeName(req.URL.Path), outcome)
+	}
+}
+
+// setUpstream records the host a request was sent to
+func setUpstream(req *http.Request, host string) {
+	if info := GetRequestInfo(req); info != nil {
+		info.Upstream = host
+	}
+}
+
+// setRequestEntry records the route and entry of a request
+func setRequestEntry(req *http.Request, route *Route, id string) {
+	info := GetRequestInfo(req)
+	if info == nil {
+		return
+	}
+	if route != nil {
+		info.Route = route.Name
+	}
+	info.EntryID = id
+}
+
+// upstreamRead reports the amount of bytes read from the proxy target for a request path
+func (b *backend) upstreamRead(reqPath string, n int64) {
+	if b.onUpstreamRead == nil || n <= 0 {
+		return
+	}
+	b.onUpstreamRead(b.routeName(reqPath), n)
+}
+
+// filled reports an entry that was stored in the cache
+func (b *backend) filled(e *Entry, source FillSource, size int64) {
+	if b.onFill != nil {
+		b.onFill(b.routeName(e.Path), source, size)
+	}
+}
+
+// routeName returns the name of the route of a request path (empty if no route matches)
+func (b *backend) routeName(reqPath string) string {
+	if r := b.route(reqPath); r != nil {
+		return r.Name
+	}
+	return ""
+}
@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hookRecorder records the outcomes and fills reported by a cache
+type hookRecorder struct {
+	m        sync.Mutex
+	outcomes []Outcome
+	fills    map[FillSource]int64
+}
+
+func newHookRecorder() *hookRecorder {
+	return &hookRecorder{fills: map[FillSource]int64{}}
+}
+
+func (r *hookRecorder) outcome(route string, outcome Outcome) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.outcomes = append(r.outcomes, outcome)
+}
+
+func (r *hookRecorder) fill(route string, source FillSource, size int64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.fills[source] += size
+}
+
+func (r *hookRecorder) filled(source FillSource) int64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.fills[source]
+}
+
+func (r *hookRecorder) lastOutcome() Outcome {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if len(r.outcomes) == 0 {
+		return ""
+	}
+	return r.outcomes[len(r.outcomes)-1]
+}
+
+func TestOutcomeAndFillHooks(t *testing.T) {
+	assert := assert.New(t)
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("foo"))
+	}))
+	defer target.Close()
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	hooks := newHookRecorder()
+	cache, err := New(&Config{
+		BackendFile:     path.Join(dir, "backend.data"),
+		CacheDir:        path.Join(dir, "cache"),
+		ProxyTarget:     target.URL,
+		CacheExpiration: time.Hour,
+		OnOutcome:       hooks.outcome,
+		OnFill:          hooks.fill,
+	})
+	assert.NoError(err)
+
+	assert.NoError(cache.CopyFromCache(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil)))
+	assert.Equal(OutcomeMiss, hooks.lastOutcome())
+	assert.Eventually(func() bool {
+		return hooks.filled(FillDownload) == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(cache.CopyFromCache(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil)))
+	assert.Equal(OutcomeHit, hooks.lastOutcome())
+
+	// the download of a refreshed entry is counted as a refresh
+	entries := cache.Entries(EntryFilter{})
+	assert.Len(entries, 1)
+	assert.NoError(cache.Refresh(entries[0].ID))
+	assert.NoError(cache.CopyFromCache(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil)))
+	assert.Equal(OutcomeMiss, hooks.lastOutcome())
+	assert.Eventually(func() bool {
+		return hooks.filled(FillRefresh) == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.EqualValues(3, hooks.filled(FillDownload))
+
+	cache.SetOffline(true)
+	res := httptest.NewRecorder()
+	assert.NoError(cache.CopyFromCache(res, httptest.NewRequest("GET", "/bar", nil)))
+	assert.Equal(http.StatusGatewayTimeout, res.Code)
+	assert.Equal(OutcomeMiss, hooks.lastOutcome())
+	assert.NoError(cache.Close(context.Background()))
+
+	// seeded and imported entries are counted without a request
+	seedDir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(seedDir)
+	assert.NoError(ioutil.WriteFile(path.Join(seedDir, "seeded"), []byte("seeded"), filePerm))
+	_, b, clean := newTestCache(t, nil)
+	defer clean()
+	b.onFill = hooks.fill
+	n, err := b.seed(SeedOptions{Dir: seedDir, Method: SeedCopy})
+	assert.NoError(err)
+	assert.Equal(1, n)
+	assert.EqualValues(6, hooks.filled(FillSeed))
+
+	src, srcBackend, clean := newTestCache(t, nil)
+	defer clean()
+	addTestEntry(t, srcBackend, "/imported", []byte("imported"), time.Now())
+	archive := &bytes.Buffer{}
+	_, err = Export(src, archive, ExportFilter{}, false)
+	assert.NoError(err)
+	dst, _, clean := newTestCache(t, nil)
+	defer clean()
+	dst.OnFill = hooks.fill
+	n, err = Import(dst, archive)
+	assert.NoError(err)
+	assert.Equal(1, n)
+	assert.EqualValues(8, hooks.filled(FillImport))
+}
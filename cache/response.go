@@ -2,10 +2,8 @@ package cache
 
 import (
 	"io"
-	"io/ioutil"
 	"net/http"
 	"sync"
-	"time"
 
 	"github.com/pkg/errors"
 )
@@ -13,85 +11,169 @@ import (
 var (
 	// ErrReadFailed represents an error where reading from proxy failed
 	ErrReadFailed = errors.New("Failed to read from proxy target")
+	// ErrTargetUnreachable represents an error where the request to the proxy target failed
+	ErrTargetUnreachable = errors.New("Failed to reach proxy target")
 )
 
+// passThroughWindow represents the maximum amount of bytes of a body that is not cached
+// that are buffered ahead of the slowest reader
+const passThroughWindow = 4 << 20
+
 func newResponse(headers http.Header, body io.ReadCloser, responseCode int) (*response, error) {
 	rBody := &responseBody{
-		body:           []byte{},
-		writeLock:      &sync.Mutex{},
-		writeCompleted: false,
+		body:    []byte{},
+		readers: map[*responseBodyReader]struct{}{},
 	}
+	rBody.cond = sync.NewCond(&rBody.m)
 	return &response{
 		headers:      headers,
 		responseCode: responseCode,
 		body:         rBody,
-		readLock:     &sync.Mutex{},
 	}, nil
 }
 
 type response struct {
 	headers      http.Header
 	body         *responseBody
-	readLock     *sync.Mutex
 	responseCode int
 }
 
-func (r *response) cacheBody(body io.ReadCloser, cacheFile string, readWg *sync.WaitGroup) error {
-	written, err := io.Copy(r.body, body)
+// cacheBody copies the proxy body to the response buffer and stores it with the provided write function
+// If a verifier is provided, the body is only stored if it passes verification
+// and readers of the response buffer will fail if it does not.
+// Returns the size of the body.
+func (r *response) cacheBody(body io.ReadCloser, v *verifier, write func([]byte) error) (int64, error) {
+	var src io.Reader = body
+	if v != nil {
+		src = io.TeeReader(body, v)
+	}
+	written, err := io.Copy(r.body, src)
 	body.Close()
-	r.body.MarkWriteCompleted(written, err)
 	if err != nil {
-		return errors.Wrap(err, "failed to copy proxy body to cache")
+		r.body.MarkWriteCompleted(err)
+		return written, errors.Wrap(err, "failed to copy proxy body to cache")
 	}
-
-	err = ioutil.WriteFile(cacheFile, r.body.body, filePerm)
+	if r.body.isPassThrough() {
+		r.body.MarkWriteCompleted(nil)
+		return written, errNotAdmitted
+	}
+	if v != nil {
+		err = v.verify()
+	}
+	r.body.MarkWriteCompleted(err)
 	if err != nil {
-		return errors.Wrap(err, "failed to write cache to file")
+		return written, errors.Wrap(err, "failed to verify proxy body")
 	}
 
-	readWg.Wait()
-	r.body.body = nil
-	r.body = nil
-
-	return nil
-}
+	err = write(r.body.bytes())
+	if err != nil {
+		return written, errors.Wrap(err, "failed to write cache to file")
+	}
 
-func (r *response) getReader() io.Reader {
-	return r.body.GetReader()
+	return written, nil
 }
 
+// responseBody buffers a body of the proxy target for the readers that stream it while it is downloaded
+// The entry drops the buffer once the download is done, readers that are still streaming keep it until they are closed
 type responseBody struct {
+	m              sync.Mutex
+	cond           *sync.Cond // signalled when the body or a reader changed
 	body           []byte
-	writeLock      *sync.Mutex
+	offset         int64 // position of the first byte of body, bytes before it are dropped in pass through mode
+	size           int64 // amount of bytes written
 	writeCompleted bool
 	readErr        error
-	bodySize       int64
+	passThrough    bool // the body is not cached, only the bytes the readers still need are kept
+	readers        map[*responseBodyReader]struct{}
 }
 
 func (rb *responseBody) Write(p []byte) (int, error) {
+	rb.m.Lock()
+	defer rb.m.Unlock()
 	if rb.writeCompleted {
 		return 0, errors.New("cache response body has already been written to")
 	}
-	rb.writeLock.Lock()
-	defer rb.writeLock.Unlock()
+	if rb.passThrough {
+		if len(rb.readers) == 0 {
+			// nobody is left to stream the body to
+			return 0, errNotAdmitted
+		}
+		// wait for the slowest reader instead of buffering the whole body
+		for len(rb.readers) > 0 && rb.size-rb.slowestReader() > passThroughWindow {
+			rb.cond.Wait()
+		}
+	}
 	rb.body = append(rb.body, p...)
+	rb.size += int64(len(p))
+	rb.trim()
+	rb.cond.Broadcast()
+
 	return len(p), nil
 }
 
 // MarkWriteCompleted mark that the full body has been copied
-func (rb *responseBody) MarkWriteCompleted(written int64, err error) {
-	rb.writeLock.Lock()
+func (rb *responseBody) MarkWriteCompleted(err error) {
+	rb.m.Lock()
+	defer rb.m.Unlock()
 	rb.writeCompleted = true
-	rb.bodySize = written
 	rb.readErr = err
-	rb.writeLock.Unlock()
+	rb.cond.Broadcast()
+}
+
+// setPassThrough stops buffering the bytes that all readers have read
+// Make sure no new readers are added after this is called
+func (rb *responseBody) setPassThrough() {
+	rb.m.Lock()
+	defer rb.m.Unlock()
+	rb.passThrough = true
+	rb.trim()
+}
+
+func (rb *responseBody) isPassThrough() bool {
+	rb.m.Lock()
+	defer rb.m.Unlock()
+	return rb.passThrough
+}
+
+// bytes returns the buffered body
+func (rb *responseBody) bytes() []byte {
+	rb.m.Lock()
+	defer rb.m.Unlock()
+	return rb.body
 }
 
-func (rb *responseBody) GetReader() *responseBodyReader {
-	return &responseBodyReader{
-		rb: rb,
-		i:  0,
+// slowestReader returns the position of the reader that read the least
+// Make sure to execute this when the body is locked
+func (rb *responseBody) slowestReader() int64 {
+	pos := rb.size
+	for r := range rb.readers {
+		if r.i < pos {
+			pos = r.i
+		}
 	}
+	return pos
+}
+
+// trim drops the bytes all readers have read in pass through mode
+// Make sure to execute this when the body is locked
+func (rb *responseBody) trim() {
+	if !rb.passThrough {
+		return
+	}
+	pos := rb.slowestReader()
+	rb.body = rb.body[pos-rb.offset:]
+	rb.offset = pos
+}
+
+// newReader returns a reader of the body from the start
+// Readers must be closed so the buffer can be released
+func (rb *responseBody) newReader() *responseBodyReader {
+	rb.m.Lock()
+	defer rb.m.Unlock()
+	r := &responseBodyReader{rb: rb}
+	rb.readers[r] = struct{}{}
+
+	return r
 }
 
 type responseBodyReader struct {
@@ -100,22 +182,37 @@ type responseBodyReader struct {
 }
 
 // Read implements io.Read
-// When nothing to read it will wait for 100 milliseconds
+// When nothing to read it waits until more of the body is written
 func (r *responseBodyReader) Read(b []byte) (int, error) {
-	if r.rb.readErr != nil {
-		err := errors.Wrap(ErrReadFailed, r.rb.readErr.Error())
-		return 0, err
-	}
-
-	if r.i >= int64(len(r.rb.body)) {
-		if r.rb.writeCompleted {
+	rb := r.rb
+	rb.m.Lock()
+	defer rb.m.Unlock()
+	for {
+		if rb.readErr != nil {
+			return 0, errors.Wrap(ErrReadFailed, rb.readErr.Error())
+		}
+		if r.i < rb.size {
+			n := copy(b, rb.body[r.i-rb.offset:])
+			r.i += int64(n)
+			if rb.passThrough {
+				rb.cond.Broadcast()
+			}
+			return n, nil
+		}
+		if rb.writeCompleted {
 			return 0, io.EOF
 		}
-		time.Sleep(100 * time.Millisecond)
-		return 0, nil
+		rb.cond.Wait()
 	}
-	n := copy(b, r.rb.body[r.i:])
-	r.i += int64(n)
+}
 
-	return n, nil
+// Close stops the reader from holding back the buffer
+func (r *responseBodyReader) Close() error {
+	rb := r.rb
+	rb.m.Lock()
+	defer rb.m.Unlock()
+	delete(rb.readers, r)
+	rb.cond.Broadcast()
+
+	return nil
 }
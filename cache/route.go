@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Route represents a set of caching rules that apply to requests
+// of which the path starts with the route prefix
+type Route struct {
+	// Name represents the name of the route, used in logs
+	Name string `json:"name"`
+	// Prefix represents the request path prefix the route applies to
+	Prefix string `json:"prefix"`
+	// Checksum represents the checksum verification rule of the route (optional)
+	Checksum *ChecksumRule `json:"checksum,omitempty"`
+	// Compression represents the rules for which cached bodies are compressed on disk
+	// The first matching rule applies, bodies are not compressed if none match
+	Compression []*CompressionRule `json:"compression,omitempty"`
+	// Frequency represents the rule for how often a request should be requested before it is cached (optional)
+	Frequency *FrequencyRule `json:"frequency,omitempty"`
+}
+
+// validate checks if the rules of the route are usable
+func (r *Route) validate() error {
+	if r.Checksum != nil {
+		err := r.Checksum.validate()
+		if err != nil {
+			return errors.Wrap(err, "invalid checksum rule")
+		}
+	}
+	for _, c := range r.Compression {
+		err := c.validate()
+		if err != nil {
+			return errors.Wrap(err, "invalid compression rule")
+		}
+	}
+	if r.Frequency != nil {
+		err := r.Frequency.validate()
+		if err != nil {
+			return errors.Wrap(err, "invalid frequency rule")
+		}
+	}
+
+	return nil
+}
+
+// matches checks if the route applies to the provided request path
+func (r *Route) matches(reqPath string) bool {
+	return strings.HasPrefix(reqPath, r.Prefix)
+}
+
+// ValidateRoutes checks if the rules of the routes are usable
+func ValidateRoutes(routes []*Route) error {
+	for _, r := range routes {
+		err := r.validate()
+		if err != nil {
+			return errors.Wrapf(err, "invalid route %s", r.Name)
+		}
+	}
+
+	return nil
+}
+
+// route returns the route with the longest prefix matching the request path
+// returns nil if no route matches
+func (b *backend) route(reqPath string) *Route {
+	b.settingsM.RLock()
+	defer b.settingsM.RUnlock()
+	return findRoute(b.routes, reqPath)
+}
+
+// expiration returns the amount of time a cache entry is valid
+func (b *backend) expiration() time.Duration {
+	b.settingsM.RLock()
+	defer b.settingsM.RUnlock()
+	return b.cacheExpiration
+}
+
+// reconfigure replaces the routes and the cache expiration
+func (b *backend) reconfigure(routes []*Route, expiration time.Duration) {
+	b.settingsM.Lock()
+	defer b.settingsM.Unlock()
+	b.sketches = newFrequencySketches(routes, b.sketches)
+	b.routes = routes
+	b.cacheExpiration = expiration
+}
+
+// findRoute returns the route with the longest prefix matching the request path
+// returns nil if no route matches
+func findRoute(routes []*Route, reqPath string) *Route {
+	var match *Route
+	for _, r := range routes {
+		if !r.matches(reqPath) {
+			continue
+		}
+		if match == nil || len(r.Prefix) > len(match.Prefix) {
+			match = r
+		}
+	}
+
+	return match
+}
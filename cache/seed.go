@@ -0,0 +1,254 @@
+package cache
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Methods of adding seeded files to the cache
+const (
+	// SeedCopy copies the files into the cache
+	SeedCopy = "copy"
+	// SeedHardlink hardlinks the files into the cache
+	SeedHardlink = "hardlink"
+	// SeedReflink clones the files into the cache on filesystems that support copy on write
+	SeedReflink = "reflink"
+)
+
+// SeedOptions represents a directory tree the cache is seeded with
+type SeedOptions struct {
+	// Dir represents the directory of which all files are added to the cache
+	Dir string `json:"dir"`
+	// Prefix represents the request path of Dir
+	Prefix string `json:"prefix"`
+	// Method represents how the files are added to the cache (copy, hardlink or reflink)
+	// Files that can not be linked or cloned, eg: as they are on another filesystem
+	// or as the cache is encrypted or compressed, are copied
+	Method string `json:"method"`
+	// Overwrite replaces entries that are already cached
+	Overwrite bool `json:"overwrite"`
+}
+
+func (o *SeedOptions) validate() error {
+	if o.Dir == "" {
+		return errors.New("no seed dir provided")
+	}
+	switch o.Method {
+	case "":
+		o.Method = SeedCopy
+	case SeedCopy, SeedHardlink, SeedReflink:
+	default:
+		return errors.Errorf("invalid seed method %s", o.Method)
+	}
+
+	return nil
+}
+
+// Seed adds all files of a directory tree to the cache of a stopped server
+// Returns the amount of seeded entries
+func Seed(c *Config, opts SeedOptions) (int, error) {
+	b, err := openBackend(c)
+	if err != nil {
+		return 0, err
+	}
+	err = b.pruneEntries()
+	if err != nil {
+		return 0, err
+	}
+
+	return b.seed(opts)
+}
+
+// Seed adds all files of a directory tree to the cache
+// Returns the amount of seeded entries
+func (c *Cache) Seed(opts SeedOptions) (int, error) {
+	return c.b.seed(opts)
+}
+
+func (b *backend) seed(opts SeedOptions) (int, error) {
+	err := opts.validate()
+	if err != nil {
+		return 0, err
+	}
+
+	seeded := 0
+	err = walkFiles(opts.Dir, func(file string, info os.FileInfo) {
+		if !info.Mode().IsRegular() {
+			return
+		}
+		rel, err := filepath.Rel(opts.Dir, file)
+		if err != nil {
+			log.Errorf("Failed to seed %s: %s", file, err)
+			return
+		}
+		reqPath := path.Join("/", opts.Prefix, filepath.ToSlash(rel))
+		ok, err := b.seedFile(reqPath, file, info, opts)
+		if err != nil {
+			log.Errorf("Failed to seed %s: %s", file, err)
+			return
+		}
+		if ok {
+			log.Debugf("Seeded %s with %s", reqPath, file)
+			seeded++
+		}
+	})
+	if err != nil {
+		return seeded, err
+	}
+
+	b.m.Lock()
+	err = b.save()
+	b.m.Unlock()
+
+	return seeded, err
+}
+
+// seedFile adds a file to the cache as the body of a request path
+// Returns false if the file was not added as the request path is already cached or being cached
+func (b *backend) seedFile(reqPath, file string, info os.FileInfo, opts SeedOptions) (bool, error) {
+	params := url.Values{}
+	_, existing := b.findEntry(reqPath, params)
+	if existing != nil && !b.seedable(existing, opts) {
+		return false, nil
+	}
+	if !b.admitSize(info.Size()) {
+		log.Debugf("Not seeding %s of %d bytes", file, info.Size())
+		return false, nil
+	}
+	v, err := b.pickVolume(reqPath + "?" + params.Encode())
+	if err != nil {
+		return false, err
+	}
+
+	headers := http.Header{}
+	headers.Set("Content-Type", mime.TypeByExtension(path.Ext(reqPath)))
+	e := newEntry(reqPath, params)
+	e.Status = StateCached
+	e.InitTime = JSONTime(time.Now())
+	e.LastAccess = e.InitTime
+	e.Encoding = compressionFor(b.route(reqPath), reqPath, headers)
+	e.Size = info.Size()
+	e.Volume = v.Dir
+	b.m.Lock()
+	id := b.generateID()
+	b.m.Unlock()
+	e.CachedFile = v.generateCacheFileName(id)
+
+	err = b.storeSeedFile(e, file, opts.Method)
+	if err != nil {
+		return false, err
+	}
+
+	// a request could have created an entry for the path while the file was stored
+	b.m.Lock()
+	for existingID, existing := range b.data {
+		if existing.Path != reqPath || len(existing.Params) != 0 {
+			continue
+		}
+		if !b.seedable(existing, opts) {
+			b.m.Unlock()
+			os.Remove(e.CachedFile)
+			return false, nil
+		}
+		// the cache file of the replaced entry is deleted by the next cache dir cleanup
+		delete(b.data, existingID)
+		if b.mem != nil {
+			b.mem.remove(existingID)
+		}
+	}
+	b.data[id] = e
+	b.m.Unlock()
+	b.filled(e, FillSeed, e.Size)
+
+	return true, nil
+}
+
+// seedable checks if an existing entry can be replaced by a seeded file
+func (b *backend) seedable(e *Entry, opts SeedOptions) bool {
+	switch e.Status {
+	case StateInProgress:
+		return false
+	case StateCached:
+		return opts.Overwrite
+	}
+	return true
+}
+
+// storeSeedFile stores file as the cache file of e
+// Files that need to be compressed or encrypted are always copied
+func (b *backend) storeSeedFile(e *Entry, file, method string) error {
+	err := os.MkdirAll(filepath.Dir(e.CachedFile), dirPerm)
+	if err != nil {
+		return err
+	}
+	if e.Encoding != "" || b.crypt != nil {
+		method = SeedCopy
+	}
+
+	switch method {
+	case SeedHardlink:
+		err = os.Link(file, e.CachedFile)
+		if err == nil {
+			b.addSeedUsed(e)
+			return nil
+		}
+		log.Debugf("Failed to hardlink %s, copying it instead: %s", file, err)
+	case SeedReflink:
+		err = b.reflinkFile(e, file)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("Failed to reflink %s, copying it instead: %s", file, err)
+	}
+
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return b.storeCacheFile(e, func(w io.Writer) error {
+		return writeEncoded(w, src, e.Encoding)
+	})
+}
+
+// reflinkFile clones file to the cache file of e
+func (b *backend) reflinkFile(e *Entry, file string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := createAtomic(e.CachedFile)
+	if err != nil {
+		return err
+	}
+	err = reflink(f.File, src)
+	if err != nil {
+		f.abort()
+		return err
+	}
+	err = f.commit()
+	if err != nil {
+		return err
+	}
+	b.addSeedUsed(e)
+
+	return nil
+}
+
+func (b *backend) addSeedUsed(e *Entry) {
+	e.Encrypted = false
+	if v := b.findVolume(e.Volume); v != nil {
+		v.addUsed(e.Size)
+	}
+}
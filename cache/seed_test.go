@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeed(t *testing.T) {
+	assert := assert.New(t)
+	_, b, clean := newTestCache(t, nil)
+	defer clean()
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	assert.NoError(os.MkdirAll(path.Join(dir, "dists", "stable"), dirPerm))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "dists", "stable", "Release"), []byte("release"), filePerm))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "pool.deb"), []byte("deb"), filePerm))
+	addTestEntry(t, b, "/debian/pool.deb", []byte("cached deb"), time.Now())
+
+	n, err := b.seed(SeedOptions{Dir: dir, Prefix: "/debian", Method: SeedHardlink})
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	id, e := b.findEntry("/debian/dists/stable/Release", nil)
+	assert.Nil(e)
+	id, e = b.findEntry("/debian/dists/stable/Release", map[string][]string{})
+	assert.NotNil(e)
+	assert.Equal(StateCached, e.Status)
+	assert.Equal(int64(7), e.Size)
+	src, err := os.Stat(path.Join(dir, "dists", "stable", "Release"))
+	assert.NoError(err)
+	dst, err := os.Stat(b.data[id].CachedFile)
+	assert.NoError(err)
+	assert.True(os.SameFile(src, dst))
+
+	// cached entries are only replaced when overwriting
+	_, e = b.findEntry("/debian/pool.deb", map[string][]string{})
+	body, err := b.readCacheFile(e)
+	assert.NoError(err)
+	assert.Equal("cached deb", string(body))
+
+	// encrypted caches get copies
+	b.crypt, err = newEncryptor(bytes.Repeat([]byte{0x42}, 32))
+	assert.NoError(err)
+	n, err = b.seed(SeedOptions{Dir: dir, Prefix: "/debian", Method: SeedHardlink, Overwrite: true})
+	assert.NoError(err)
+	assert.Equal(2, n)
+	assert.Len(b.data, 2)
+	_, e = b.findEntry("/debian/pool.deb", map[string][]string{})
+	assert.True(e.Encrypted)
+	body, err = b.readCacheFile(e)
+	assert.NoError(err)
+	assert.Equal("deb", string(body))
+}
@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Close stops the cache once the downloads in progress are finished and saves the backend file
+// Downloads that are not finished when the context is done are aborted, their entries are downloaded again on their next request
+// The cache can not be used after it is closed
+func (c *Cache) Close(ctx context.Context) error {
+	return c.b.close(ctx)
+}
+
+func (b *backend) close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		b.fills.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("Aborting downloads in progress, they are downloaded again on their next request")
+		b.cancelFills()
+		<-done
+	}
+	b.cancelFills()
+	close(b.quit)
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	err := b.save()
+	if err != nil {
+		return err
+	}
+	log.Debug("Saved backend file")
+
+	return b.lock.close()
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseAbortsDownloads(t *testing.T) {
+	assert := assert.New(t)
+	nosave = false
+	stall := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("foo"))
+		res.(http.Flusher).Flush()
+		select {
+		case <-stall:
+		case <-req.Context().Done():
+		}
+	}))
+	defer target.Close()
+	defer close(stall)
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	c := &Config{
+		BackendFile: path.Join(dir, "backend.data"),
+		CacheDir:    path.Join(dir, "cache"),
+		ProxyTarget: target.URL,
+	}
+	cache, err := New(c)
+	assert.NoError(err)
+
+	served := make(chan error)
+	go func() {
+		served <- cache.CopyFromCache(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	}()
+	assert.Eventually(func() bool {
+		return cache.Stats().States[StateInProgress] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NoError(cache.Close(ctx))
+	assert.Error(<-served)
+
+	// the entry is downloaded again on its next request
+	b, err := openBackend(c)
+	assert.NoError(err)
+	assert.Len(b.data, 1)
+	for _, e := range b.data {
+		assert.Equal(StateInit, e.Status)
+	}
+}
@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// writeCacheFile writes the body of an entry to its cache file
+// The body is compressed with the entry encoding and encrypted if encryption is enabled
+func (b *backend) writeCacheFile(e *Entry, data []byte) error {
+	return b.storeCacheFile(e, func(w io.Writer) error {
+		return writeEncoded(w, bytes.NewReader(data), e.Encoding)
+	})
+}
+
+// storeCacheFile stores the cache file of an entry with the data written by write
+// write should write the body as it is stored (compressed with the entry encoding),
+// the data is encrypted if encryption is enabled
+// The cache file only appears once it is fully written and synced to disk
+func (b *backend) storeCacheFile(e *Entry, write func(io.Writer) error) error {
+	err := os.MkdirAll(filepath.Dir(e.CachedFile), dirPerm)
+	if err != nil {
+		return err
+	}
+	f, err := createAtomic(e.CachedFile)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = f
+	var crypt io.WriteCloser
+	if b.crypt != nil {
+		crypt, err = b.crypt.newWriter(f)
+		if err != nil {
+			f.abort()
+			return errors.Wrap(err, "failed to encrypt cache file")
+		}
+		w = crypt
+	}
+	e.m.Lock()
+	e.Encrypted = b.crypt != nil
+	e.m.Unlock()
+
+	err = write(w)
+	if err == nil && crypt != nil {
+		err = crypt.Close()
+	}
+	if err != nil {
+		f.abort()
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.abort()
+		return err
+	}
+	err = f.commit()
+	if err != nil {
+		return err
+	}
+	if v := b.findVolume(e.Volume); v != nil {
+		v.addUsed(info.Size())
+	}
+
+	return nil
+}
+
+// writeEncoded copies r to w, compressed with the provided encoding
+func writeEncoded(w io.Writer, r io.Reader, encoding string) error {
+	if encoding == "" {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	enc, err := newEncoder(w, encoding)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(enc, r)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to compress cache file with %s", encoding)
+	}
+
+	return nil
+}
+
+// openCacheFile opens the cache file of an entry as it was written (compressed with the entry encoding)
+// Encrypted cache files are decrypted while reading
+// The returned closer should be closed when done reading
+func (b *backend) openCacheFile(e *Entry) (io.ReadSeeker, io.Closer, error) {
+	f, err := os.Open(e.CachedFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !e.Encrypted {
+		return f, f, nil
+	}
+
+	if b.crypt == nil {
+		f.Close()
+		return nil, nil, ErrEncryptionKeyMissing
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	r, err := b.crypt.newReader(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "failed to decrypt cache file")
+	}
+
+	return r, f, nil
+}
+
+// readCacheFile returns the full uncompressed body of an entry
+func (b *backend) readCacheFile(e *Entry) ([]byte, error) {
+	body, closer, err := b.openCacheFile(e)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	if e.Encoding == "" {
+		return ioutil.ReadAll(body)
+	}
+
+	dec, err := newDecoder(body, e.Encoding)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress cached file")
+	}
+	defer dec.Close()
+
+	return ioutil.ReadAll(dec)
+}
+
+// migrateLayout moves cache files of a previous run that are stored directly in the volume dir
+// to the sharded layout
+func (b *backend) migrateLayout() {
+	migrated := 0
+	for id, e := range b.entries() {
+		v := b.findVolume(e.Volume)
+		if v == nil || filepath.Dir(filepath.Clean(e.CachedFile)) != filepath.Clean(v.Dir) {
+			continue
+		}
+		file := v.generateCacheFileName(id)
+		err := os.MkdirAll(filepath.Dir(file), dirPerm)
+		if err == nil {
+			err = os.Rename(e.CachedFile, file)
+		}
+		if err != nil {
+			log.Errorf("Failed to migrate cache file %s: %s", e.CachedFile, err)
+			continue
+		}
+		err = b.setEntryCacheFile(id, file)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		migrated++
+	}
+	if migrated > 0 {
+		log.Infof("Migrated %d cache files to the sharded cache dir layout", migrated)
+	}
+}
+
+// removeTempFiles removes temporary files of unfinished writes of a previous run
+func (b *backend) removeTempFiles() {
+	for _, v := range b.volumes {
+		if !v.isAvailable() {
+			continue
+		}
+		err := walkFiles(v.Dir, func(file string, info os.FileInfo) {
+			if !isTempFile(file) {
+				return
+			}
+			log.Debugf("Deleting temporary file %s", file)
+			err := os.Remove(file)
+			if err != nil {
+				log.Errorf("Failed to delete temporary file %s: %s", file, err)
+			}
+		})
+		if err != nil {
+			log.Errorf("Failed to list cache dir files: %s", err)
+		}
+	}
+
+	// temporary files of the backend file and its backups are written next to it
+	files, err := ioutil.ReadDir(filepath.Dir(b.filePath))
+	if err != nil {
+		log.Errorf("Failed to list backend file dir files: %s", err)
+		return
+	}
+	prefix := filepath.Base(b.filePath) + "."
+	for _, info := range files {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), prefix) || !isTempFile(info.Name()) {
+			continue
+		}
+		file := filepath.Join(filepath.Dir(b.filePath), info.Name())
+		log.Debugf("Deleting temporary file %s", file)
+		err := os.Remove(file)
+		if err != nil {
+			log.Errorf("Failed to delete temporary file %s: %s", file, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteCacheFile(t *testing.T) {
+	assert := assert.New(t)
+	volumes, clean := newTestVolumes(t, 1)
+	defer clean()
+	crypt, err := newEncryptor(bytes.Repeat([]byte{0x42}, 32))
+	assert.NoError(err)
+	b := &backend{
+		volumes: volumes,
+		crypt:   crypt,
+	}
+	data := []byte("foobar")
+
+	e := &Entry{
+		Volume:     volumes[0].Dir,
+		CachedFile: volumes[0].generateCacheFileName("foo"),
+		Encoding:   EncodingGzip,
+		m:          &sync.Mutex{},
+	}
+	assert.NoError(b.writeCacheFile(e, data))
+	assert.True(e.Encrypted)
+	result, err := b.readCacheFile(e)
+	assert.NoError(err)
+	assert.Equal(data, result)
+
+	// only the cache file remains in its directory
+	files, err := ioutil.ReadDir(filepath.Dir(e.CachedFile))
+	assert.NoError(err)
+	assert.Len(files, 1)
+	assert.Equal(path.Base(e.CachedFile), files[0].Name())
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	assert := assert.New(t)
+	volumes, clean := newTestVolumes(t, 1)
+	defer clean()
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	b := &backend{
+		volumes:  volumes,
+		filePath: path.Join(dir, "backend.data"),
+	}
+
+	// temporary files of a cache file, the backend file and a backup of the backend file
+	temp := []string{}
+	for _, file := range []string{path.Join(volumes[0].Dir, "foo.blob"), b.filePath, backupFile(b.filePath, 1)} {
+		f, err := createAtomic(file)
+		assert.NoError(err)
+		f.Write([]byte("foo"))
+		f.Close()
+		assert.True(isTempFile(f.Name()))
+		assert.True(fileExists(f.Name()))
+		temp = append(temp, f.Name())
+	}
+	// temporary files of other files next to the backend file are kept
+	other := path.Join(dir, "other.data.123"+tempFileSuffix)
+	assert.NoError(ioutil.WriteFile(other, nil, filePerm))
+
+	b.removeTempFiles()
+	for _, file := range temp {
+		assert.False(fileExists(file), file)
+	}
+	assert.True(fileExists(other))
+}
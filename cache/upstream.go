@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUpstreamStalled represents a body of the proxy target that sent no data within the body idle timeout
+	ErrUpstreamStalled = errors.New("proxy target stopped sending the body")
+)
+
+// UpstreamConfig represents the timeouts of the requests to the proxy target
+// A timeout of 0 disables it
+type UpstreamConfig struct {
+	// DialTimeout represents the maximum amount of time to connect to the proxy target
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	// TLSHandshakeTimeout represents the maximum amount of time of the TLS handshake with the proxy target
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+	// ResponseHeaderTimeout represents the maximum amount of time to wait for the response headers
+	// after the request is sent
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	// BodyIdleTimeout represents the maximum amount of time the proxy target can stop sending the body
+	// before the request is aborted
+	BodyIdleTimeout time.Duration `yaml:"body_idle_timeout"`
+}
+
+// Validate checks if the timeouts are usable
+func (c UpstreamConfig) Validate() error {
+	if c.DialTimeout < 0 || c.TLSHandshakeTimeout < 0 || c.ResponseHeaderTimeout < 0 || c.BodyIdleTimeout < 0 {
+		return errors.New("upstream timeouts can not be negative")
+	}
+	return nil
+}
+
+// NewUpstreamClient returns a client for requests to the proxy target with the timeouts of the config
+// The body idle timeout is applied by reading the body through NewStallReader
+func NewUpstreamClient(c UpstreamConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+
+	return &http.Client{Transport: transport}
+}
+
+// NewStallReader returns a reader of a body that is closed when a read gets no data for the provided timeout,
+// reads of a closed body fail with ErrUpstreamStalled
+// Only the time spent waiting for the body counts, not the time the reader spends on the data
+// The body is returned as is if the timeout is 0
+func NewStallReader(body io.ReadCloser, timeout time.Duration) io.ReadCloser {
+	if timeout <= 0 {
+		return body
+	}
+	r := &stallReader{
+		body:    body,
+		timeout: timeout,
+	}
+	r.timer = time.AfterFunc(timeout, r.stall)
+	r.timer.Stop()
+
+	return r
+}
+
+// stallReader aborts a body that stopped sending data
+type stallReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	m       sync.Mutex
+	stalled bool
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.stalled {
+		return n, errors.Wrapf(ErrUpstreamStalled, "no data received for %s", r.timeout)
+	}
+
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+// stall closes the body so the blocked read returns
+func (r *stallReader) stall() {
+	r.m.Lock()
+	r.stalled = true
+	r.m.Unlock()
+	r.body.Close()
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStalledDownload(t *testing.T) {
+	assert := assert.New(t)
+	stall := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/headers" {
+			<-stall
+			return
+		}
+		res.Write([]byte("foo"))
+		res.(http.Flusher).Flush()
+		select {
+		case <-stall:
+		case <-req.Context().Done():
+		}
+	}))
+	defer target.Close()
+	defer close(stall)
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	cache, err := New(&Config{
+		BackendFile: path.Join(dir, "backend.data"),
+		CacheDir:    path.Join(dir, "cache"),
+		ProxyTarget: target.URL,
+		Upstream: UpstreamConfig{
+			ResponseHeaderTimeout: 50 * time.Millisecond,
+			BodyIdleTimeout:       50 * time.Millisecond,
+		},
+	})
+	assert.NoError(err)
+
+	// the download is aborted and the entry is downloaded again on its next request
+	err = cache.CopyFromCache(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	assert.Equal(ErrReadFailed, errors.Cause(err))
+	assert.Eventually(func() bool {
+		return cache.Stats().States[StateInit] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	err = cache.CopyFromCache(httptest.NewRecorder(), httptest.NewRequest("GET", "/headers", nil))
+	assert.Equal(ErrTargetUnreachable, errors.Cause(err))
+	assert.Equal(2, cache.Stats().States[StateInit])
+	assert.NoError(cache.Close(context.Background()))
+}
+
+func TestStallReader(t *testing.T) {
+	assert := assert.New(t)
+	r := NewStallReader(ioutil.NopCloser(&slowReader{delay: 100 * time.Millisecond}), 10*time.Millisecond)
+	_, err := r.Read(make([]byte, 1))
+	assert.Equal(ErrUpstreamStalled, errors.Cause(err))
+
+	r = NewStallReader(ioutil.NopCloser(&slowReader{}), 50*time.Millisecond)
+	_, err = r.Read(make([]byte, 1))
+	assert.NoError(err)
+	// time spent between reads does not count
+	time.Sleep(100 * time.Millisecond)
+	_, err = r.Read(make([]byte, 1))
+	assert.NoError(err)
+	assert.NoError(r.Close())
+}
+
+// slowReader returns a byte after a delay
+type slowReader struct {
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	p[0] = 'a'
+	return 1, nil
+}
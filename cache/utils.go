@@ -1,12 +1,13 @@
 package cache
 
 import (
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
-	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,6 +17,8 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+const walkBatchSize = 1024
+
 const base64URLCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
 
 // generateID returns a random base64URL string of provided length
@@ -80,23 +83,63 @@ func (t JSONTime) String() string {
 	return t.Time().String()
 }
 
-func listFiles(dir string) ([]string, error) {
-	fList := []string{}
-	files, err := ioutil.ReadDir(dir)
+// JSONDuration is a time.Duration wrapper that JSON (un)marshals into a duration string (eg: 1h30m)
+type JSONDuration time.Duration
+
+// MarshalJSON is used to convert the duration to JSON
+func (d JSONDuration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(time.Duration(d).String())), nil
+}
+
+// UnmarshalJSON is used to convert the duration from JSON
+func (d *JSONDuration) UnmarshalJSON(s []byte) error {
+	str, err := strconv.Unquote(string(s))
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to read dir %s", dir)
+		return errors.Wrap(err, "duration should be a string")
 	}
-
-	for _, f := range files {
-		fList = append(fList, f.Name())
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
 	}
+	*d = JSONDuration(duration)
 
-	return fList, nil
+	return nil
 }
 
-func deletefile(dir string, file string) error {
-	path := path.Join(dir, file)
-	return os.RemoveAll(path)
+// Duration returns the JSON duration as a time.Duration
+func (d JSONDuration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+// walkFiles calls fn for every file in dir and its subdirectories
+// Directory entries are read in batches, so large directories are not read in memory at once
+func walkFiles(dir string, fn func(file string, info os.FileInfo)) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read dir %s", dir)
+	}
+	defer d.Close()
+
+	for {
+		infos, err := d.Readdir(walkBatchSize)
+		for _, info := range infos {
+			file := filepath.Join(dir, info.Name())
+			if !info.IsDir() {
+				fn(file, info)
+				continue
+			}
+			err := walkFiles(file, fn)
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read dir %s", dir)
+		}
+	}
 }
 
 func removeDirContent(dir string) error {
@@ -119,12 +162,68 @@ func removeDirContent(dir string) error {
 	return nil
 }
 
-func inStringSlice(s []string, i string) bool {
-	for _, j := range s {
-		if j == i {
-			return true
-		}
+const tempFileSuffix = ".tmp"
+
+// createAtomic creates a temporary file in the directory of file
+// that is only moved to the file path once it is committed
+func createAtomic(file string) (*atomicFile, error) {
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*"+tempFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Chmod(filePerm)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return &atomicFile{
+		File: f,
+		path: file,
+	}, nil
+}
+
+// atomicFile represents a file that is written to a temporary file first
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+// commit syncs the temporary file to disk and moves it to its path
+func (f *atomicFile) commit() error {
+	err := f.Sync()
+	if err != nil {
+		f.abort()
+		return errors.Wrap(err, "failed to sync file")
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	err = os.Rename(f.Name(), f.path)
+	if err != nil {
+		os.Remove(f.Name())
+		return err
 	}
 
-	return false
+	// sync the directory so the rename is persisted
+	d, err := os.Open(filepath.Dir(f.path))
+	if err != nil {
+		return nil
+	}
+	d.Sync()
+	return d.Close()
+}
+
+// abort removes the temporary file
+func (f *atomicFile) abort() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// isTempFile checks if a file is a temporary file of createAtomic
+func isTempFile(file string) bool {
+	return strings.HasSuffix(file, tempFileSuffix)
 }
@@ -0,0 +1,221 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"math"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// PlacementRoundRobin stores cached bodies on the volumes in turn
+	PlacementRoundRobin = "round-robin"
+	// PlacementMostFree stores cached bodies on the volume with the most free space
+	PlacementMostFree = "most-free"
+	// PlacementHash stores cached bodies on a volume picked by consistent hashing of the request
+	PlacementHash = "hash"
+)
+
+var (
+	// ErrNoVolume represents an error where no cache volume is available to store a body
+	ErrNoVolume = errors.New("no cache volume available")
+)
+
+// Volume represents a directory where cached bodies are stored
+type Volume struct {
+	// Dir represents the directory of the volume
+	Dir string `json:"dir"`
+	// Capacity represents the maximum amount of bytes stored in the volume (0 is only limited by disk space)
+	Capacity int64 `json:"capacity"`
+}
+
+func newVolumes(vols []*Volume) ([]*volume, error) {
+	if len(vols) == 0 {
+		return nil, errors.New("cache dir not provided")
+	}
+	volumes := []*volume{}
+	for _, v := range vols {
+		if v.Dir == "" {
+			return nil, errors.New("cache dir not provided")
+		}
+		for _, existing := range volumes {
+			if path.Clean(existing.Dir) == path.Clean(v.Dir) {
+				return nil, errors.Errorf("cache dir %s is provided more than once", v.Dir)
+			}
+		}
+		volumes = append(volumes, &volume{
+			Volume: *v,
+			m:      &sync.Mutex{},
+		})
+	}
+
+	return volumes, nil
+}
+
+// volume represents the state of a cache volume
+type volume struct {
+	Volume
+	m         *sync.Mutex
+	used      int64 // bytes used by cache files
+	available bool
+	full      bool // over the high disk watermark
+}
+
+// check checks if the volume directory is usable, creating it if it does not exist and create is set
+// Returns true if the availability of the volume changed
+func (v *volume) check(create bool) bool {
+	available := true
+	info, err := os.Stat(v.Dir)
+	if os.IsNotExist(err) && create {
+		log.Debugf("Creating cache dir %s", v.Dir)
+		err = os.MkdirAll(v.Dir, dirPerm)
+	} else if err == nil && !info.IsDir() {
+		err = errors.New("not a directory")
+	}
+	if err != nil {
+		log.Errorf("Cache volume %s is not available: %s", v.Dir, err)
+		available = false
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	changed := v.available != available
+	v.available = available
+
+	return changed
+}
+
+// isAvailable checks if the volume can be used
+func (v *volume) isAvailable() bool {
+	v.m.Lock()
+	defer v.m.Unlock()
+	return v.available
+}
+
+// free returns the amount of bytes that can still be stored on the volume
+func (v *volume) free() int64 {
+	_, free, err := diskSpace(v.Dir)
+	if err != nil {
+		log.Debugf("Failed to get free disk space of %s: %s", v.Dir, err)
+		free = math.MaxInt64
+	}
+	v.m.Lock()
+	defer v.m.Unlock()
+	if v.Capacity > 0 && v.Capacity-v.used < free {
+		free = v.Capacity - v.used
+	}
+
+	return free
+}
+
+// addUsed adds the size of a file stored on the volume
+func (v *volume) addUsed(size int64) {
+	v.m.Lock()
+	v.used += size
+	v.m.Unlock()
+}
+
+// setUsed sets the amount of bytes used by cache files on the volume
+func (v *volume) setUsed(size int64) {
+	v.m.Lock()
+	v.used = size
+	v.m.Unlock()
+}
+
+// generateCacheFileName generates a new cache file path in the volume for an entry
+// Cache files are sharded in two levels of subdirectories by their name (ab/cd/abcd...blob)
+// to keep the amount of files per directory small
+func (v *volume) generateCacheFileName(id string) string {
+	h := sha256.Sum256([]byte(id + "_" + generateID(10)))
+	name := hex.EncodeToString(h[:16])
+	return path.Join(v.Dir, name[0:2], name[2:4], name+".blob")
+}
+
+// pickVolume returns the volume a new cached body should be stored in according to the placement policy
+// key is used for consistent hashing
+func (b *backend) pickVolume(key string) (*volume, error) {
+	candidates := []*volume{}
+	for _, v := range b.volumes {
+		if !v.isAvailable() || v.isFull() || v.free() <= 0 {
+			continue
+		}
+		candidates = append(candidates, v)
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoVolume
+	}
+
+	switch b.placement {
+	case PlacementMostFree:
+		var most *volume
+		var mostFree int64
+		for _, v := range candidates {
+			free := v.free()
+			if most == nil || free > mostFree {
+				most, mostFree = v, free
+			}
+		}
+		return most, nil
+	case PlacementHash:
+		// rendezvous hashing, only keys of a missing volume move to another volume
+		var best *volume
+		var bestScore uint64
+		for _, v := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(v.Dir))
+			h.Write([]byte(key))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = v, score
+			}
+		}
+		return best, nil
+	default:
+		b.m.Lock()
+		v := candidates[b.nextVolume%len(candidates)]
+		b.nextVolume++
+		b.m.Unlock()
+		return v, nil
+	}
+}
+
+// findVolume returns the volume a cache file is stored in
+func (b *backend) findVolume(dir string) *volume {
+	for _, v := range b.volumes {
+		if path.Clean(v.Dir) == path.Clean(dir) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// checkVolumes checks the availability of the volumes
+// Entries stored on a volume that is no longer available are dropped
+func (b *backend) checkVolumes() {
+	for _, v := range b.volumes {
+		// a volume dir that was removed or unmounted is not created again, its entries are dropped
+		if !v.check(false) {
+			continue
+		}
+		if v.isAvailable() {
+			log.Debugf("Cache volume %s is available", v.Dir)
+			continue
+		}
+		log.Warnf("Dropping entries of unavailable cache volume %s", v.Dir)
+		for eID, e := range b.entries() {
+			e.m.Lock()
+			onVolume := e.Volume == v.Dir
+			e.m.Unlock()
+			if onVolume {
+				b.dropEntry(eID)
+			}
+		}
+		v.setUsed(0)
+	}
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestVolumes(t *testing.T, count int) ([]*volume, func()) {
+	root, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(t, err)
+	vols := []*Volume{}
+	for _, name := range []string{"a", "b", "c"}[:count] {
+		vols = append(vols, &Volume{Dir: path.Join(root, name)})
+	}
+	volumes, err := newVolumes(vols)
+	assert.NoError(t, err)
+	for _, v := range volumes {
+		v.check(true)
+	}
+
+	return volumes, func() { os.RemoveAll(root) }
+}
+
+func TestPickVolume(t *testing.T) {
+	assert := assert.New(t)
+	volumes, clean := newTestVolumes(t, 3)
+	defer clean()
+	b := &backend{
+		volumes: volumes,
+		m:       &sync.Mutex{},
+	}
+
+	// round robin
+	picked := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		v, err := b.pickVolume("/foo")
+		assert.NoError(err)
+		picked[v.Dir] = true
+	}
+	assert.Len(picked, 3)
+
+	// hash picks the same volume for a key
+	b.placement = PlacementHash
+	v1, err := b.pickVolume("/foo")
+	assert.NoError(err)
+	v2, err := b.pickVolume("/foo")
+	assert.NoError(err)
+	assert.Equal(v1, v2)
+
+	// full volumes are skipped
+	b.placement = PlacementMostFree
+	volumes[0].Capacity = 10
+	volumes[0].setUsed(10)
+	volumes[1].Capacity = 10
+	volumes[1].setUsed(5)
+	volumes[2].Capacity = 10
+	volumes[2].setUsed(7)
+	v, err := b.pickVolume("/foo")
+	assert.NoError(err)
+	assert.Equal(volumes[1], v)
+
+	for _, v := range volumes {
+		v.setUsed(10)
+	}
+	_, err = b.pickVolume("/foo")
+	assert.Equal(ErrNoVolume, err)
+}
+
+func TestCheckVolumes(t *testing.T) {
+	assert := assert.New(t)
+	nosave = true
+	volumes, clean := newTestVolumes(t, 2)
+	defer clean()
+	b := &backend{
+		volumes: volumes,
+		m:       &sync.Mutex{},
+		data: map[string]*Entry{
+			"1": {Status: StateCached, Volume: volumes[0].Dir, m: &sync.Mutex{}},
+			"2": {Status: StateCached, Volume: volumes[1].Dir, m: &sync.Mutex{}},
+		},
+	}
+
+	// a removed volume dir is not created again
+	assert.NoError(os.RemoveAll(volumes[0].Dir))
+	b.checkVolumes()
+
+	assert.False(volumes[0].isAvailable())
+	_, err := os.Stat(volumes[0].Dir)
+	assert.True(os.IsNotExist(err))
+	assert.True(volumes[1].isAvailable())
+	_, ok := b.data["1"]
+	assert.False(ok)
+	_, ok = b.data["2"]
+	assert.True(ok)
+
+	// the volume is used again once it is back
+	assert.NoError(os.Mkdir(volumes[0].Dir, dirPerm))
+	b.checkVolumes()
+	assert.True(volumes[0].isAvailable())
+}
+
+func TestMissingCacheFile(t *testing.T) {
+	assert := assert.New(t)
+	var requests int32
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		res.Write([]byte("foo"))
+	}))
+	defer target.Close()
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	cache, err := New(&Config{
+		BackendFile: path.Join(dir, "backend.data"),
+		CacheDir:    path.Join(dir, "cache"),
+		ProxyTarget: target.URL,
+	})
+	assert.NoError(err)
+	defer cache.Close(context.Background())
+
+	assert.NoError(cache.CopyFromCache(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil)))
+	assert.Eventually(func() bool {
+		return cache.Stats().States[StateCached] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the cached file is gone before the volume check noticed, the request is served as a miss
+	assert.NoError(os.RemoveAll(path.Join(dir, "cache")))
+	res := httptest.NewRecorder()
+	assert.NoError(cache.CopyFromCache(res, httptest.NewRequest("GET", "/foo", nil)))
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal("foo", res.Body.String())
+	assert.Equal("MISS", res.Header().Get("X-Cache"))
+	assert.EqualValues(2, atomic.LoadInt32(&requests))
+	assert.Eventually(func() bool {
+		return cache.Stats().States[StateCached] == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/chrisvdg/cacheserver/cache"
+	"github.com/chrisvdg/cacheserver/server"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// commands represents the subcommands of the cacheserver next to serving
+// the commands that operate on the cache storage should be run while the server is stopped
+var commands = map[string]func(args []string){
+	"export":       runExport,
+	"import":       runImport,
+	"seed":         runSeed,
+	"fsck":         runFsck,
+	"check-config": runCheckConfig,
+}
+
+// storageFlags represents the flags that locate the cache storage
+// Storage settings that are not provided as flag are read from the environment variables and the config file like when serving
+type storageFlags struct {
+	fs                *pflag.FlagSet
+	configFile        *string
+	backendFile       *string
+	cacheDir          *string
+	cacheVolumes      *[]string
+	placement         *string
+	encryptionKeyFile *string
+	verbose           *bool
+}
+
+func addStorageFlags(fs *pflag.FlagSet) *storageFlags {
+	defaults := server.DefaultConfig()
+	return &storageFlags{
+		fs:                fs,
+		configFile:        fs.String("config", "", "YAML config file of the server, the settings of the environment variables and the provided flags override the settings of the file. Defaults to the "+server.ConfigFileEnv+" environment variable"),
+		backendFile:       fs.StringP("backendfile", "f", defaults.BackendFile, "backend metadata file"),
+		cacheDir:          fs.StringP("cachedir", "d", defaults.CacheDir, "directory where cached downloads are stored"),
+		cacheVolumes:      fs.StringArray("cachevolume", nil, "directory where cached downloads are stored with an optional capacity in bytes. Can be provided multiple times or separated by commas and overrides --cachedir"),
+		placement:         fs.String("placement", defaults.Placement, "policy that picks the cache volume a download is stored on (round-robin, most-free or hash)"),
+		encryptionKeyFile: fs.String("encryptionkeyfile", "", "file with the key the cache is encrypted with. Defaults to the "+server.EncryptionKeyEnv+" environment variable"),
+		verbose:           fs.BoolP("verbose", "v", false, "Verbose output"),
+	}
+}
+
+// serverConfig returns the server config of the config file and the environment variables
+// with the storage flags that are provided applied
+func (f *storageFlags) serverConfig() (*server.Config, error) {
+	return server.LoadConfig(*f.configFile, func(c *server.Config) (err error) {
+		if f.fs.Changed("backendfile") {
+			c.BackendFile = *f.backendFile
+		}
+		if f.fs.Changed("cachedir") {
+			c.CacheDir = *f.cacheDir
+		}
+		if f.fs.Changed("cachevolume") {
+			c.CacheVolumes, err = server.ParseVolumes(*f.cacheVolumes...)
+			if err != nil {
+				return errors.Wrap(err, "invalid value of flag --cachevolume")
+			}
+		}
+		if f.fs.Changed("placement") {
+			c.Placement = *f.placement
+		}
+		if f.fs.Changed("encryptionkeyfile") {
+			c.EncryptionKeyFile = *f.encryptionKeyFile
+		}
+		return nil
+	})
+}
+
+// config returns the cache config of the storage settings
+func (f *storageFlags) config() (*cache.Config, error) {
+	c, err := f.serverConfig()
+	if err != nil {
+		return nil, err
+	}
+	return cacheConfig(c)
+}
+
+// cacheConfig returns the config of the cache of a server config with the files it refers to loaded
+func cacheConfig(c *server.Config) (*cache.Config, error) {
+	var err error
+	if c.RoutesFile != "" {
+		c.Routes, err = server.LoadRoutes(c.RoutesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.EncryptionKey, err = server.LoadEncryptionKey(c.EncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.CacheConfig(), nil
+}
+
+func setupLogging(verbose bool) {
+	if verbose {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+	log.SetFormatter(&log.TextFormatter{
+		FullTimestamp:   true,
+		TimestampFormat: "15:04:05 02/01/2006",
+	})
+}
+
+// newCommandFlagSet returns the flag set of a subcommand
+func newCommandFlagSet(name, usage string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(name, pflag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: cacheserver %s %s\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runExport(args []string) {
+	fs := newCommandFlagSet("export", "[flags]")
+	storage := addStorageFlags(fs)
+	output := fs.StringP("output", "o", "-", "file the archive is written to, - writes to stdout")
+	prefix := fs.String("prefix", "", "only export entries of which the request path starts with the prefix")
+	maxAge := fs.String("maxage", "0", "only export entries cached less than this amount of time ago. eg: --maxage 48h. Or provide 0 to export all entries")
+	compress := fs.Bool("zstd", false, "compress the archive with zstd")
+	fs.Parse(args)
+	setupLogging(*storage.verbose)
+
+	age, err := time.ParseDuration(*maxAge)
+	if err != nil {
+		log.Fatalf("Failed to parse max age: %s", err)
+	}
+	c, err := storage.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var f *os.File
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err = os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create archive: %s", err)
+		}
+		w = f
+	}
+	n, err := cache.Export(c, w, cache.ExportFilter{
+		Prefix: *prefix,
+		MaxAge: age,
+	}, *compress)
+	if f != nil {
+		closeErr := f.Close()
+		if err == nil && closeErr != nil {
+			err = errors.Wrap(closeErr, "failed to write archive")
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Exported %d cache entries", n)
+}
+
+func runImport(args []string) {
+	fs := newCommandFlagSet("import", "[flags] <archive>")
+	storage := addStorageFlags(fs)
+	fs.Parse(args)
+	setupLogging(*storage.verbose)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c, err := storage.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to open archive: %s", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	n, err := cache.Import(c, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Imported %d cache entries", n)
+}
+
+func runSeed(args []string) {
+	fs := newCommandFlagSet("seed", "[flags] <dir>")
+	storage := addStorageFlags(fs)
+	prefix := fs.String("prefix", "/", "request path of the seeded directory")
+	method := fs.String("method", cache.SeedCopy, "how files are added to the cache (copy, hardlink or reflink). Files that can not be linked are copied")
+	overwrite := fs.Bool("overwrite", false, "replace entries that are already cached")
+	routesFile := fs.StringP("routesfile", "r", "", "JSON file with caching rules per request path prefix, used to compress seeded files. Defaults to the routes of the config file")
+	fs.Parse(args)
+	setupLogging(*storage.verbose)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	sc, err := storage.serverConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fs.Changed("routesfile") {
+		sc.RoutesFile = *routesFile
+		sc.Routes = nil
+	}
+	c, err := cacheConfig(sc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	n, err := cache.Seed(c, cache.SeedOptions{
+		Dir:       fs.Arg(0),
+		Prefix:    *prefix,
+		Method:    *method,
+		Overwrite: *overwrite,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Seeded %d cache entries", n)
+}
+
+// Exit codes of the fsck command
+const (
+	fsckOK      = 0
+	fsckFixed   = 1
+	fsckUnfixed = 4
+	fsckFailed  = 8
+)
+
+func runFsck(args []string) {
+	fs := newCommandFlagSet("fsck", "[flags]")
+	storage := addStorageFlags(fs)
+	fix := fs.Bool("fix", false, "repair the inconsistencies, dangling, stuck and corrupt entries are dropped")
+	orphans := fs.String("orphans", cache.OrphanKeep, "what to do with files no entry references when repairing (keep, adopt or delete). Adopted files are moved to the lost+found directory next to the backend file")
+	rehash := fs.Bool("rehash", false, "read every cache file in full to verify it")
+	jsonOutput := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: cacheserver fsck [flags]\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExit codes: %d no inconsistencies, %d all inconsistencies repaired, %d inconsistencies left, %d check failed\n",
+			fsckOK, fsckFixed, fsckUnfixed, fsckFailed)
+	}
+	fs.Parse(args)
+	setupLogging(*storage.verbose)
+
+	c, err := storage.config()
+	if err != nil {
+		log.Error(err)
+		os.Exit(fsckFailed)
+	}
+	report, err := cache.Fsck(c, cache.FsckOptions{
+		Fix:     *fix,
+		Orphans: *orphans,
+		Rehash:  *rehash,
+	})
+	if err != nil {
+		log.Error(err)
+		os.Exit(fsckFailed)
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(report)
+	} else {
+		for _, i := range report.Issues {
+			status := "found"
+			if i.Fixed {
+				status = "fixed"
+			}
+			fmt.Printf("%s\t%s\tid=%s path=%s file=%s %s\n", status, i.Kind, i.ID, i.Path, i.File, i.Detail)
+		}
+		fmt.Printf("%d entries, %d files, %d issues, %d unfixed\n", report.Entries, report.Files, len(report.Issues), report.Unfixed())
+	}
+
+	switch {
+	case report.Unfixed() > 0:
+		os.Exit(fsckUnfixed)
+	case len(report.Issues) > 0:
+		os.Exit(fsckFixed)
+	}
+}
+
+func runCheckConfig(args []string) {
+	fs := newCommandFlagSet("check-config", "<config file>\nThe settings of the environment variables override the settings of the file like they do when serving")
+	fs.Parse(args)
+	setupLogging(false)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c := server.DefaultConfig()
+	err := server.LoadConfigFile(fs.Arg(0), c)
+	if err == nil {
+		err = server.LoadEnv(c)
+	}
+	if err == nil {
+		err = c.LoadFiles()
+	}
+	if err == nil {
+		err = c.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Config file %s is valid\n", fs.Arg(0))
+}
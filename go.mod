@@ -4,9 +4,12 @@ go 1.14
 
 require (
 	github.com/gorilla/mux v1.7.4
+	github.com/klauspost/compress v1.11.13
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.1
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/sys v0.0.0-20220408201424-a24fb2fb8a0f // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
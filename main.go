@@ -1,66 +1,178 @@
 package main
 
 import (
+	"os"
 	"time"
 
 	"github.com/chrisvdg/cacheserver/server"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 )
 
 func main() {
-	listAddr := pflag.StringP("listenaddr", "l", ":8080", "http listen address")
-	tlsListAddr := pflag.StringP("tlsaddr", "t", "8443", "https listen address")
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
+	defaults := server.DefaultConfig()
+	configFile := pflag.String("config", "", "YAML config file, the settings of the environment variables and the provided flags override the settings of the file. The file is loaded again on SIGHUP. Defaults to the "+server.ConfigFileEnv+" environment variable")
+	listAddr := pflag.StringP("listenaddr", "l", defaults.ListenAddr, "http listen address")
+	tlsListAddr := pflag.StringP("tlsaddr", "t", defaults.TLSListenAddr, "https listen address")
 	tlsKey := pflag.StringP("tlskey", "k", "", "TLS private key file path")
 	tlsCert := pflag.StringP("tlscert", "c", "", "TLS certificate file path")
 	tlsOnly := pflag.BoolP("tlsonly", "s", false, "Only serve TLS")
 	target := pflag.StringP("proxytarget", "p", "", "Target server to proxy")
-	backendFile := pflag.StringP("backendfile", "f", "./cachebackend.data", "backend metadata file")
-	cacheDir := pflag.StringP("cachedir", "d", "./cachebackend", "directory where cached downloads will be stored")
-	cacheExpiration := pflag.StringP("cacheexpiration", "e", "24h", "amount of time a cache entry is valid. eg: -e 1h2m (1 hour and 2 minutes). Or provide 0 to disable")
-	cacheCleanInterval := pflag.StringP("chachecleanint", "i", "12h", "amount of time where in between the cache will be cleaned up.  eg: -e 4h (4 hours). Or provide 0 to disable")
+	backendFile := pflag.StringP("backendfile", "f", defaults.BackendFile, "backend metadata file")
+	cacheDir := pflag.StringP("cachedir", "d", defaults.CacheDir, "directory where cached downloads will be stored")
+	cacheVolumes := pflag.StringArray("cachevolume", nil, "directory where cached downloads will be stored with an optional capacity in bytes, eg: --cachevolume /mnt/disk1=1073741824. Can be provided multiple times or separated by commas and overrides --cachedir")
+	placement := pflag.String("placement", defaults.Placement, "policy that picks the cache volume a download is stored on (round-robin, most-free or hash)")
+	cacheExpiration := pflag.StringP("cacheexpiration", "e", defaults.CacheExpiration.String(), "amount of time a cache entry is valid. eg: -e 1h2m (1 hour and 2 minutes). Or provide 0 to disable")
+	cacheCleanInterval := pflag.StringP("chachecleanint", "i", defaults.CacheCleanupInterval.String(), "amount of time where in between the cache will be cleaned up.  eg: -e 4h (4 hours). Or provide 0 to disable")
+	routesFile := pflag.StringP("routesfile", "r", "", "JSON file with caching rules per request path prefix")
+	diskHigh := pflag.Float64("diskhighwatermark", defaults.DiskHighWatermark, "percentage of disk usage of a cache volume at which cache entries are evicted. Or provide 0 to disable")
+	diskLow := pflag.Float64("disklowwatermark", defaults.DiskLowWatermark, "percentage of disk usage of a cache volume cache entries are evicted to. Or provide 0 to use the high watermark")
+	evictionPolicy := pflag.String("evictionpolicy", defaults.EvictionPolicy, "order in which cache entries are evicted (lru or fifo)")
+	encryptionKeyFile := pflag.String("encryptionkeyfile", "", "file with the key to encrypt the cache with (16, 24 or 32 bytes, hex/base64 encoded or raw). Defaults to the "+server.EncryptionKeyEnv+" environment variable")
+	minObjectSize := pflag.Int64("minobjectsize", 0, "minimum size in bytes of a download to be cached")
+	maxObjectSize := pflag.Int64("maxobjectsize", 0, "maximum size in bytes of a download to be cached. Or provide 0 to disable")
+	memCacheSize := pflag.Int64("memcachesize", 0, "maximum amount of bytes of small, frequently requested entries held in memory. Or provide 0 to disable")
+	memCacheMaxObject := pflag.Int64("memcachemaxobject", defaults.MemoryCache.MaxObjectSize, "maximum size in bytes of an entry held in memory")
+	memCacheMinHits := pflag.Int("memcacheminhits", defaults.MemoryCache.MinHits, "amount of cache hits an entry needs before it is held in memory")
+	adminAddr := pflag.String("adminaddr", "", "separate listen address of the admin endpoints, eg: --adminaddr localhost:8081, requires an admin token. Otherwise the admin endpoints are served under /_admin if an admin token is configured")
+	metrics := pflag.Bool("metrics", false, "serve Prometheus metrics on /metrics of the admin listener, or of the http listener if no admin listener is configured")
+	internalPrefix := pflag.String("internalprefix", defaults.InternalPrefix, "path prefix the health probes and metrics are served under on the http listener, eg: --internalprefix /_cacheserver, so they do not shadow paths of the proxy target")
+	adminTokenFile := pflag.String("admintokenfile", "", "file with the bearer token that enables and authenticates the admin endpoints under /_admin. Defaults to the "+server.AdminTokenEnv+" environment variable")
+	seedDirs := pflag.StringArray("seeddir", nil, "directory the admin seed endpoint can seed the cache from, including its subdirectories. Can be provided multiple times. Seeding through the admin endpoint is disabled if none is provided")
+	accessLog := pflag.String("accesslog", "", "file the access log is written to, or - for stdout. The file is reopened on SIGUSR1. Or leave empty to disable")
+	accessLogFormat := pflag.String("accesslogformat", defaults.AccessLogFormat, "format of the access log (common, combined or json)")
+	shutdownTimeout := pflag.String("shutdowntimeout", defaults.ShutdownTimeout.String(), "amount of time requests and downloads in progress get to finish when the server shuts down on SIGINT or SIGTERM. Downloads that do not finish are downloaded again on their next request")
+	readHeaderTimeout := pflag.String("readheadertimeout", defaults.ReadHeaderTimeout.String(), "amount of time a client gets to send the request headers. Or provide 0 to disable")
+	idleTimeout := pflag.String("idletimeout", defaults.IdleTimeout.String(), "amount of time an idle keep-alive connection of a client is kept open. Or provide 0 to disable")
+	writeTimeout := pflag.String("writetimeout", defaults.WriteTimeout.String(), "amount of time a response can take to be written, this includes large downloads. Or provide 0 to disable")
+	upstreamDialTimeout := pflag.String("upstreamdialtimeout", defaults.Upstream.DialTimeout.String(), "amount of time to connect to the proxy target. Or provide 0 to disable")
+	upstreamTLSTimeout := pflag.String("upstreamtlstimeout", defaults.Upstream.TLSHandshakeTimeout.String(), "amount of time of the TLS handshake with the proxy target. Or provide 0 to disable")
+	upstreamHeaderTimeout := pflag.String("upstreamheadertimeout", defaults.Upstream.ResponseHeaderTimeout.String(), "amount of time to wait for the response headers of the proxy target. Or provide 0 to disable")
+	upstreamIdleTimeout := pflag.String("upstreamidletimeout", defaults.Upstream.BodyIdleTimeout.String(), "amount of time the proxy target can stop sending a body before the download is aborted, an aborted download is downloaded again on its next request. Or provide 0 to disable")
+	offline := pflag.Bool("offline", false, "only serve requests from the cache without contacting the proxy target, expired entries included. Requests that are not cached get a 504 response. Can be switched at runtime through /_admin/offline")
+	autoOffline := pflag.Bool("autooffline", defaults.AutoOffline, "switch to offline mode while the proxy target is unreachable. Provide --autooffline=false to keep proxying requests that are not cached")
 	verbose := pflag.BoolP("verbose", "v", false, "Verbose output")
 	pflag.Parse()
 
-	if *verbose {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
+	// flags override the environment variables and the config file if they are provided
+	overrides := map[string]func(c *server.Config) error{
+		"listenaddr":  func(c *server.Config) error { c.ListenAddr = *listAddr; return nil },
+		"tlsaddr":     func(c *server.Config) error { c.TLSListenAddr = *tlsListAddr; return nil },
+		"tlskey":      func(c *server.Config) error { c.TLS.KeyFile = *tlsKey; return nil },
+		"tlscert":     func(c *server.Config) error { c.TLS.CertFile = *tlsCert; return nil },
+		"tlsonly":     func(c *server.Config) error { c.TLSOnly = *tlsOnly; return nil },
+		"proxytarget": func(c *server.Config) error { c.ProxyTarget = *target; return nil },
+		"backendfile": func(c *server.Config) error { c.BackendFile = *backendFile; return nil },
+		"cachedir":    func(c *server.Config) error { c.CacheDir = *cacheDir; return nil },
+		"cachevolume": func(c *server.Config) (err error) {
+			c.CacheVolumes, err = server.ParseVolumes(*cacheVolumes...)
+			return errors.Wrap(err, "invalid value of flag --cachevolume")
+		},
+		"placement": func(c *server.Config) error { c.Placement = *placement; return nil },
+		"cacheexpiration": func(c *server.Config) (err error) {
+			c.CacheExpiration, err = time.ParseDuration(*cacheExpiration)
+			return errors.Wrap(err, "invalid value of flag --cacheexpiration")
+		},
+		"chachecleanint": func(c *server.Config) (err error) {
+			c.CacheCleanupInterval, err = time.ParseDuration(*cacheCleanInterval)
+			return errors.Wrap(err, "invalid value of flag --chachecleanint")
+		},
+		"routesfile": func(c *server.Config) error {
+			c.RoutesFile = *routesFile
+			c.Routes = nil
+			return nil
+		},
+		"diskhighwatermark": func(c *server.Config) error { c.DiskHighWatermark = *diskHigh; return nil },
+		"disklowwatermark":  func(c *server.Config) error { c.DiskLowWatermark = *diskLow; return nil },
+		"evictionpolicy":    func(c *server.Config) error { c.EvictionPolicy = *evictionPolicy; return nil },
+		"encryptionkeyfile": func(c *server.Config) error { c.EncryptionKeyFile = *encryptionKeyFile; return nil },
+		"minobjectsize":     func(c *server.Config) error { c.MinObjectSize = *minObjectSize; return nil },
+		"maxobjectsize":     func(c *server.Config) error { c.MaxObjectSize = *maxObjectSize; return nil },
+		"memcachesize":      func(c *server.Config) error { c.MemoryCache.MaxSize = *memCacheSize; return nil },
+		"memcachemaxobject": func(c *server.Config) error { c.MemoryCache.MaxObjectSize = *memCacheMaxObject; return nil },
+		"memcacheminhits":   func(c *server.Config) error { c.MemoryCache.MinHits = *memCacheMinHits; return nil },
+		"adminaddr":         func(c *server.Config) error { c.AdminListenAddr = *adminAddr; return nil },
+		"metrics":           func(c *server.Config) error { c.Metrics = *metrics; return nil },
+		"internalprefix":    func(c *server.Config) error { c.InternalPrefix = *internalPrefix; return nil },
+		"admintokenfile":    func(c *server.Config) error { c.AdminTokenFile = *adminTokenFile; return nil },
+		"seeddir":           func(c *server.Config) error { c.SeedDirs = *seedDirs; return nil },
+		"accesslog":         func(c *server.Config) error { c.AccessLog = *accessLog; return nil },
+		"accesslogformat":   func(c *server.Config) error { c.AccessLogFormat = *accessLogFormat; return nil },
+		"offline":           func(c *server.Config) error { c.Offline = *offline; return nil },
+		"autooffline":       func(c *server.Config) error { c.AutoOffline = *autoOffline; return nil },
+		"verbose":           func(c *server.Config) error { c.Verbose = *verbose; return nil },
+		"shutdowntimeout": func(c *server.Config) (err error) {
+			c.ShutdownTimeout, err = time.ParseDuration(*shutdownTimeout)
+			return errors.Wrap(err, "invalid value of flag --shutdowntimeout")
+		},
+		"readheadertimeout": func(c *server.Config) (err error) {
+			c.ReadHeaderTimeout, err = time.ParseDuration(*readHeaderTimeout)
+			return errors.Wrap(err, "invalid value of flag --readheadertimeout")
+		},
+		"idletimeout": func(c *server.Config) (err error) {
+			c.IdleTimeout, err = time.ParseDuration(*idleTimeout)
+			return errors.Wrap(err, "invalid value of flag --idletimeout")
+		},
+		"writetimeout": func(c *server.Config) (err error) {
+			c.WriteTimeout, err = time.ParseDuration(*writeTimeout)
+			return errors.Wrap(err, "invalid value of flag --writetimeout")
+		},
+		"upstreamdialtimeout": func(c *server.Config) (err error) {
+			c.Upstream.DialTimeout, err = time.ParseDuration(*upstreamDialTimeout)
+			return errors.Wrap(err, "invalid value of flag --upstreamdialtimeout")
+		},
+		"upstreamtlstimeout": func(c *server.Config) (err error) {
+			c.Upstream.TLSHandshakeTimeout, err = time.ParseDuration(*upstreamTLSTimeout)
+			return errors.Wrap(err, "invalid value of flag --upstreamtlstimeout")
+		},
+		"upstreamheadertimeout": func(c *server.Config) (err error) {
+			c.Upstream.ResponseHeaderTimeout, err = time.ParseDuration(*upstreamHeaderTimeout)
+			return errors.Wrap(err, "invalid value of flag --upstreamheadertimeout")
+		},
+		"upstreamidletimeout": func(c *server.Config) (err error) {
+			c.Upstream.BodyIdleTimeout, err = time.ParseDuration(*upstreamIdleTimeout)
+			return errors.Wrap(err, "invalid value of flag --upstreamidletimeout")
+		},
 	}
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp:   true,
-		TimestampFormat: "15:04:05 02/01/2006",
-	})
+	load := func() (*server.Config, error) {
+		c, err := server.LoadConfig(*configFile, func(c *server.Config) (err error) {
+			pflag.Visit(func(f *pflag.Flag) {
+				if apply, ok := overrides[f.Name]; ok && err == nil {
+					err = apply(c)
+				}
+			})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = c.LoadFiles()
+		if err != nil {
+			return nil, err
+		}
 
-	cacheExp, err := time.ParseDuration(*cacheExpiration)
-	if err != nil {
-		log.Fatalf("Failed to parse cache expiration: %s", err)
-	}
-	cacheInt, err := time.ParseDuration(*cacheCleanInterval)
-	if err != nil {
-		log.Fatalf("Failed to parse cache cleaning interval: %s", err)
+		return c, c.Validate()
 	}
 
-	c := &server.Config{
-		ListenAddr:    *listAddr,
-		TLSListenAddr: *tlsListAddr,
-		TLSOnly:       *tlsOnly,
-		TLS: &server.TLSConfig{
-			KeyFile:  *tlsKey,
-			CertFile: *tlsCert,
-		},
-		ProxyTarget:          *target,
-		BackendFile:          *backendFile,
-		CacheDir:             *cacheDir,
-		Verbose:              *verbose,
-		CacheExpiration:      cacheExp,
-		CacheCleanupInterval: cacheInt,
+	c, err := load()
+	if err != nil {
+		log.Fatal(err)
 	}
+	setupLogging(c.Verbose)
 
 	s, err := server.New(c)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	s.SetLoader(load)
 	s.ListenAndServe()
 }
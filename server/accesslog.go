@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chrisvdg/cacheserver/cache"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AccessLogCommon represents the Apache common log format
+	AccessLogCommon = "common"
+	// AccessLogCombined represents the Apache combined log format
+	AccessLogCombined = "combined"
+	// AccessLogJSON represents an access log with a JSON object per line
+	AccessLogJSON = "json"
+)
+
+// AccessLogStdout represents the access log destination that writes to stdout
+const AccessLogStdout = "-"
+
+// validAccessLogFormat checks if an access log format is supported
+func validAccessLogFormat(format string) error {
+	switch format {
+	case "", AccessLogCommon, AccessLogCombined, AccessLogJSON:
+		return nil
+	default:
+		return errors.Errorf("access log format %s is not supported", format)
+	}
+}
+
+// accessLog writes a line per served request
+// Nothing is written if no file is configured
+type accessLog struct {
+	file   string
+	format string
+	m      sync.Mutex
+	out    io.Writer
+	closer io.Closer
+}
+
+func newAccessLog(file, format string) (*accessLog, error) {
+	l := &accessLog{}
+	err := l.configure(file, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// configure sets the destination and format of the access log
+// The destination is only reopened if it changed
+func (l *accessLog) configure(file, format string) error {
+	err := validAccessLogFormat(format)
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		format = AccessLogCombined
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.format = format
+	if file == l.file && l.out != nil {
+		return nil
+	}
+	l.close()
+	l.file = file
+
+	return l.open()
+}
+
+// open opens the destination of the access log
+// Make sure to execute this when the access log is locked
+func (l *accessLog) open() error {
+	switch l.file {
+	case "":
+		return nil
+	case AccessLogStdout:
+		l.out = os.Stdout
+		return nil
+	}
+	f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open access log")
+	}
+	l.out = f
+	l.closer = f
+
+	return nil
+}
+
+// close closes the destination of the access log
+// Make sure to execute this when the access log is locked
+func (l *accessLog) close() {
+	if l.closer != nil {
+		l.closer.Close()
+	}
+	l.out = nil
+	l.closer = nil
+}
+
+// closeLog closes the access log file, nothing is written to the access log after it is closed
+func (l *accessLog) closeLog() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.close()
+}
+
+// reopen reopens the access log file so a rotated file is released
+func (l *accessLog) reopen() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closer == nil {
+		return nil
+	}
+	l.close()
+
+	return l.open()
+}
+
+// reopenOnSignal reopens the access log file whenever the process receives a reopen signal
+func (l *accessLog) reopenOnSignal(ctx context.Context) {
+	if len(reopenSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, reopenSignals...)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Debug("Reopening access log")
+			err := l.reopen()
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// accessLogEntry represents a line of the access log
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	Protocol  string    `json:"protocol"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	Outcome   string    `json:"outcome"`
+	Route     string    `json:"route,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	EntryID   string    `json:"entry_id,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// observe writes the line of a served request
+func (l *accessLog) observe(req *http.Request, w *responseRecorder, info *cache.RequestInfo, aborted bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.out == nil {
+		return
+	}
+	e := &accessLogEntry{
+		Time:      w.start,
+		ClientIP:  clientIP(req),
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Query:     req.URL.RawQuery,
+		Protocol:  req.Proto,
+		Status:    w.status,
+		Bytes:     w.written,
+		Duration:  time.Since(w.start).Seconds(),
+		Outcome:   string(requestOutcome(info)),
+		Route:     info.Route,
+		Upstream:  info.Upstream,
+		EntryID:   info.EntryID,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	var line []byte
+	if l.format == AccessLogJSON {
+		var err error
+		line, err = json.Marshal(e)
+		if err != nil {
+			log.Errorf("Failed to marshal access log entry: %s", err)
+			return
+		}
+		line = append(line, '\n')
+	} else {
+		line = e.apache(l.format == AccessLogCombined)
+	}
+
+	_, err := l.out.Write(line)
+	if err != nil {
+		log.Errorf("Failed to write access log: %s", err)
+	}
+}
+
+// apache formats the entry in the Apache common or combined log format
+// The duration in seconds, cache outcome, upstream and entry ID are appended as key=value pairs
+func (e *accessLogEntry) apache(combined bool) []byte {
+	buf := &bytes.Buffer{}
+	uri := e.Path
+	if e.Query != "" {
+		uri += "?" + e.Query
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	fmt.Fprintf(buf, "%s - - [%s] %s %d %s",
+		e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+uri+" "+e.Protocol), e.Status, size)
+	if combined {
+		fmt.Fprintf(buf, " %s %s", quoteOrDash(e.Referer), quoteOrDash(e.UserAgent))
+	}
+	fmt.Fprintf(buf, " duration=%.3f outcome=%s upstream=%s entry=%s\n",
+		e.Duration, e.Outcome, valueOrDash(e.Upstream), valueOrDash(e.EntryID))
+
+	return buf.Bytes()
+}
+
+// clientIP returns the IP address of the client of a request
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
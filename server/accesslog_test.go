@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrisvdg/cacheserver/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveLogged serves a cache hit of /foo?bar=baz and writes its access log line to the access log
+func serveLogged(l *accessLog) {
+	handler := instrument(func(res http.ResponseWriter, req *http.Request) {
+		info := cache.GetRequestInfo(req)
+		info.Outcome = cache.OutcomeHit
+		info.Route = "releases"
+		info.EntryID = "42"
+		info.Upstream = "example.com"
+		res.Write([]byte("hello"))
+	}, l.observe)
+	req := httptest.NewRequest("GET", "/foo?bar=baz", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Referer", "http://example.com/")
+	req.Header.Set("User-Agent", "test/1.0")
+	handler(httptest.NewRecorder(), req)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		format string
+		line   string
+	}{
+		{
+			format: AccessLogCommon,
+			line:   `^192\.0\.2\.1 - - \[[^\]]+\] "GET /foo\?bar=baz HTTP/1\.1" 200 5 duration=[0-9.]+ outcome=HIT upstream=example\.com entry=42\n$`,
+		},
+		{
+			format: AccessLogCombined,
+			line:   `^192\.0\.2\.1 - - \[[^\]]+\] "GET /foo\?bar=baz HTTP/1\.1" 200 5 "http://example\.com/" "test/1\.0" duration=[0-9.]+ outcome=HIT upstream=example\.com entry=42\n$`,
+		},
+		{format: AccessLogJSON},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			assert := assert.New(t)
+			file := filepath.Join(dir, test.format+".log")
+			l, err := newAccessLog(file, test.format)
+			assert.NoError(err)
+			serveLogged(l)
+			l.closeLog()
+
+			data, err := ioutil.ReadFile(file)
+			assert.NoError(err)
+			if test.format != AccessLogJSON {
+				assert.Regexp(regexp.MustCompile(test.line), string(data))
+				return
+			}
+			e := &accessLogEntry{}
+			assert.NoError(json.Unmarshal(data, e))
+			assert.Equal("192.0.2.1", e.ClientIP)
+			assert.Equal("GET", e.Method)
+			assert.Equal("/foo", e.Path)
+			assert.Equal("bar=baz", e.Query)
+			assert.Equal(http.StatusOK, e.Status)
+			assert.EqualValues(5, e.Bytes)
+			assert.Equal("HIT", e.Outcome)
+			assert.Equal("releases", e.Route)
+			assert.Equal("example.com", e.Upstream)
+			assert.Equal("42", e.EntryID)
+			assert.Equal("test/1.0", e.UserAgent)
+			assert.WithinDuration(time.Now(), e.Time, time.Minute)
+		})
+	}
+}
+
+func TestAccessLogConfigure(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	_, err = newAccessLog("", "xml")
+	assert.Error(err)
+
+	// nothing is written without a file
+	l, err := newAccessLog("", "")
+	assert.NoError(err)
+	assert.Equal(AccessLogCombined, l.format)
+	serveLogged(l)
+
+	file := filepath.Join(dir, "access.log")
+	assert.NoError(l.configure(file, AccessLogCommon))
+	serveLogged(l)
+	assert.NoError(l.configure(file, AccessLogJSON))
+	serveLogged(l)
+	l.closeLog()
+	serveLogged(l)
+
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(lines, 2) {
+		assert.True(strings.HasPrefix(lines[0], "192.0.2.1 - - ["))
+		assert.True(strings.HasPrefix(lines[1], "{"))
+	}
+}
+
+func TestAccessLogReopenOnSignal(t *testing.T) {
+	if len(reopenSignals) == 0 {
+		t.Skip("reopening the access log on a signal is not supported on this platform")
+	}
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "access.log")
+	l, err := newAccessLog(file, AccessLogCommon)
+	assert.NoError(err)
+	defer l.closeLog()
+
+	// keep the signal from terminating the test before the access log listens to it
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, reopenSignals...)
+	defer signal.Stop(guard)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.reopenOnSignal(ctx)
+
+	serveLogged(l)
+	assert.NoError(os.Rename(file, file+".1"))
+	p, err := os.FindProcess(os.Getpid())
+	assert.NoError(err)
+	assert.Eventually(func() bool {
+		assert.NoError(p.Signal(reopenSignals[0]))
+		_, err := os.Stat(file)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	serveLogged(l)
+
+	for _, f := range []string{file, file + ".1"} {
+		data, err := ioutil.ReadFile(f)
+		assert.NoError(err)
+		assert.Equal(1, strings.Count(string(data), "\n"), f)
+	}
+}
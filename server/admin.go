@@ -0,0 +1,289 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chrisvdg/cacheserver/cache"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminPrefix represents the path prefix of the admin endpoints
+// Admin requests are authenticated with a bearer token and never reach the proxy target
+const adminPrefix = "/_admin"
+
+func newAdminHandlers(token string, seedDirs []string, cache *cache.Cache, offline *offlineMode) *adminHandlers {
+	return &adminHandlers{
+		token:    token,
+		seedDirs: seedDirs,
+		backend:  cache,
+		offline:  offline,
+	}
+}
+
+type adminHandlers struct {
+	token    string
+	seedDirs []string // directories the cache can be seeded from
+	backend  *cache.Cache
+	offline  *offlineMode
+}
+
+// register adds the admin endpoints to the router
+func (h *adminHandlers) register(r *mux.Router) {
+	admin := r.PathPrefix(adminPrefix).Subrouter()
+	admin.Use(h.authenticate)
+	admin.HandleFunc("/seed", h.SeedHandler).Methods("POST")
+	admin.HandleFunc("/stats", h.StatsHandler).Methods("GET")
+	admin.HandleFunc("/entries", h.ListHandler).Methods("GET")
+	admin.HandleFunc("/entries", h.PurgeEntriesHandler).Methods("DELETE")
+	admin.HandleFunc("/entries/{id}", h.EntryHandler).Methods("GET")
+	admin.HandleFunc("/entries/{id}", h.PurgeHandler).Methods("DELETE")
+	admin.HandleFunc("/entries/{id}/refresh", h.RefreshHandler).Methods("POST")
+	admin.HandleFunc("/offline", h.OfflineHandler).Methods("GET")
+	admin.HandleFunc("/offline", h.SetOfflineHandler).Methods("PUT")
+	admin.PathPrefix("/").HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		writeError(res, http.StatusNotFound, "unknown admin endpoint")
+	})
+}
+
+// authenticate only passes requests with the admin token as bearer token
+// No requests are passed if no token is configured
+func (h *adminHandlers) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			log.Warnf("Unauthorized admin request from %s", req.RemoteAddr)
+			res.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(res, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// SeedHandler adds the files of a directory on the server to the cache
+// The request body is a JSON cache.SeedOptions object, its dir should be in one of the seed dirs
+func (h *adminHandlers) SeedHandler(res http.ResponseWriter, req *http.Request) {
+	opts := cache.SeedOptions{}
+	err := json.NewDecoder(req.Body).Decode(&opts)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, "invalid seed options: "+err.Error())
+		return
+	}
+	opts.Dir, err = h.seedDir(opts.Dir)
+	if err != nil {
+		log.Warnf("Refused seed request from %s: %s", req.RemoteAddr, err)
+		writeError(res, http.StatusForbidden, err.Error())
+		return
+	}
+	n, err := h.backend.Seed(opts)
+	if err != nil {
+		log.Errorf("Failed to seed cache from %s: %s", opts.Dir, err)
+		writeError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Infof("Seeded %d cache entries from %s", n, opts.Dir)
+	writeJSON(res, http.StatusOK, map[string]int{"seeded": n})
+}
+
+// seedDir resolves a directory to seed from
+// Returns an error if the directory is not in one of the seed dirs
+func (h *adminHandlers) seedDir(dir string) (string, error) {
+	if len(h.seedDirs) == 0 {
+		return "", errors.New("seeding is disabled, no seed dirs are configured")
+	}
+	// links are resolved so they can not point outside of the seed dirs
+	resolved, err := resolvePath(dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid seed dir %s", dir)
+	}
+	for _, root := range h.seedDirs {
+		r, err := resolvePath(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(r, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+
+	return "", errors.Errorf("seed dir %s is not in one of the seed dirs", dir)
+}
+
+// resolvePath returns the absolute path of an existing file with the links in it resolved
+func resolvePath(file string) (string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// StatsHandler returns aggregate statistics of the cache
+func (h *adminHandlers) StatsHandler(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, http.StatusOK, h.backend.Stats())
+}
+
+// ListHandler lists the cache entries
+// The entries can be filtered with the prefix, path, status, min_age and max_age query params
+func (h *adminHandlers) ListHandler(res http.ResponseWriter, req *http.Request) {
+	f, err := parseEntryFilter(req.URL.Query())
+	if err != nil {
+		writeError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(res, http.StatusOK, h.backend.Entries(f))
+}
+
+// EntryHandler shows the metadata of a cache entry
+func (h *adminHandlers) EntryHandler(res http.ResponseWriter, req *http.Request) {
+	e, err := h.backend.Entry(mux.Vars(req)["id"])
+	if err != nil {
+		writeCacheError(res, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, e)
+}
+
+// PurgeHandler removes a cache entry and its cached file
+func (h *adminHandlers) PurgeHandler(res http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	err := h.backend.Purge(id)
+	if err != nil {
+		writeCacheError(res, err)
+		return
+	}
+	log.Infof("Purged cache entry %s", id)
+	writeJSON(res, http.StatusOK, map[string]int{"purged": 1})
+}
+
+// PurgeEntriesHandler removes the cache entries that match the filter in the query params
+// A prefix or path is required, purge all entries with the prefix /
+func (h *adminHandlers) PurgeEntriesHandler(res http.ResponseWriter, req *http.Request) {
+	f, err := parseEntryFilter(req.URL.Query())
+	if err != nil {
+		writeError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+	if f.Prefix == "" && f.Path == "" {
+		writeError(res, http.StatusBadRequest, "prefix or path is required")
+		return
+	}
+	n, err := h.backend.PurgeEntries(f)
+	if err != nil {
+		writeCacheError(res, err)
+		return
+	}
+	log.Infof("Purged %d cache entries", n)
+	writeJSON(res, http.StatusOK, map[string]int{"purged": n})
+}
+
+// RefreshHandler marks a cache entry to be downloaded again on its next request
+func (h *adminHandlers) RefreshHandler(res http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	err := h.backend.Refresh(id)
+	if err != nil {
+		writeCacheError(res, err)
+		return
+	}
+	log.Infof("Refreshing cache entry %s", id)
+	e, err := h.backend.Entry(id)
+	if err != nil {
+		writeCacheError(res, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, e)
+}
+
+// OfflineHandler shows if the cache is in offline mode and why
+func (h *adminHandlers) OfflineHandler(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, http.StatusOK, h.offline.status())
+}
+
+// offlineRequest represents the body of a request that changes the offline mode
+// Settings that are not provided are kept
+type offlineRequest struct {
+	Offline *bool `json:"offline"`
+	Auto    *bool `json:"auto"`
+}
+
+// SetOfflineHandler switches the offline mode on or off, and enables or disables automatic offline mode
+func (h *adminHandlers) SetOfflineHandler(res http.ResponseWriter, req *http.Request) {
+	r := offlineRequest{}
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, "invalid offline request: "+err.Error())
+		return
+	}
+	if r.Offline == nil && r.Auto == nil {
+		writeError(res, http.StatusBadRequest, "invalid offline request: offline or auto should be provided")
+		return
+	}
+	h.offline.update(r.Offline, r.Auto)
+	writeJSON(res, http.StatusOK, h.offline.status())
+}
+
+// parseEntryFilter parses the query params of an entry filter
+func parseEntryFilter(q url.Values) (cache.EntryFilter, error) {
+	f := cache.EntryFilter{
+		Prefix: q.Get("prefix"),
+		Path:   q.Get("path"),
+		Status: cache.State(q.Get("status")),
+	}
+	switch f.Status {
+	case cache.StateInvalid, cache.StateInit, cache.StateInProgress, cache.StateCached, cache.StateNoCache:
+	default:
+		return f, errors.Errorf("invalid status %s", f.Status)
+	}
+	var err error
+	if age := q.Get("min_age"); age != "" {
+		f.MinAge, err = time.ParseDuration(age)
+		if err != nil {
+			return f, errors.Wrap(err, "invalid min_age")
+		}
+	}
+	if age := q.Get("max_age"); age != "" {
+		f.MaxAge, err = time.ParseDuration(age)
+		if err != nil {
+			return f, errors.Wrap(err, "invalid max_age")
+		}
+	}
+
+	return f, nil
+}
+
+// writeCacheError writes the JSON error response of a cache error
+func writeCacheError(res http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case cache.ErrEntryNotFound:
+		writeError(res, http.StatusNotFound, err.Error())
+	case cache.ErrEntryInProgress:
+		writeError(res, http.StatusConflict, err.Error())
+	default:
+		log.Error(err)
+		writeError(res, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// writeJSON writes v as JSON response
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	err := json.NewEncoder(res).Encode(v)
+	if err != nil {
+		log.Errorf("Failed to write JSON response: %s", err)
+	}
+}
+
+// writeError writes a JSON error response
+func writeError(res http.ResponseWriter, status int, msg string) {
+	writeJSON(res, status, map[string]string{"error": msg})
+}
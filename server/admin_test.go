@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chrisvdg/cacheserver/cache"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCache returns a cache in a temporary directory that proxies the target
+func newTestCache(t *testing.T, target string) (*cache.Cache, string, func()) {
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(t, err)
+	c, err := cache.New(&cache.Config{
+		BackendFile: filepath.Join(dir, "backend.data"),
+		CacheDir:    filepath.Join(dir, "cache"),
+		ProxyTarget: target,
+	})
+	assert.NoError(t, err)
+
+	return c, dir, func() { os.RemoveAll(dir) }
+}
+
+func TestAdminHandlers(t *testing.T) {
+	c, dir, clean := newTestCache(t, "http://localhost")
+	defer clean()
+	seedRoot := filepath.Join(dir, "seed")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(seedRoot, "debian"), outside} {
+		assert.NoError(t, os.MkdirAll(d, 0700))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(d, "file"), []byte("file"), 0600))
+	}
+	assert.NoError(t, os.Symlink(outside, filepath.Join(seedRoot, "link")))
+
+	tests := []struct {
+		name     string
+		token    string
+		seedDirs []string
+		method   string
+		path     string
+		auth     string
+		body     string
+		status   int
+	}{
+		{name: "no token", token: "secret", method: "GET", path: "/_admin/stats", status: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", method: "GET", path: "/_admin/stats", auth: "Bearer wrong", status: http.StatusUnauthorized},
+		{name: "no token configured", method: "GET", path: "/_admin/stats", auth: "Bearer ", status: http.StatusUnauthorized},
+		{name: "stats", token: "secret", method: "GET", path: "/_admin/stats", auth: "Bearer secret", status: http.StatusOK},
+		{
+			name: "seed disabled", token: "secret", method: "POST", path: "/_admin/seed", auth: "Bearer secret",
+			body: `{"dir": "` + seedRoot + `"}`, status: http.StatusForbidden,
+		},
+		{
+			name: "seed outside seed dirs", token: "secret", seedDirs: []string{seedRoot}, method: "POST", path: "/_admin/seed", auth: "Bearer secret",
+			body: `{"dir": "` + outside + `"}`, status: http.StatusForbidden,
+		},
+		{
+			name: "seed parent of seed dir", token: "secret", seedDirs: []string{seedRoot}, method: "POST", path: "/_admin/seed", auth: "Bearer secret",
+			body: `{"dir": "` + seedRoot + `/.."}`, status: http.StatusForbidden,
+		},
+		{
+			name: "seed link out of seed dir", token: "secret", seedDirs: []string{seedRoot}, method: "POST", path: "/_admin/seed", auth: "Bearer secret",
+			body: `{"dir": "` + filepath.Join(seedRoot, "link") + `"}`, status: http.StatusForbidden,
+		},
+		{
+			name: "seed unauthorized", token: "secret", seedDirs: []string{seedRoot}, method: "POST", path: "/_admin/seed",
+			body: `{"dir": "` + filepath.Join(seedRoot, "debian") + `"}`, status: http.StatusUnauthorized,
+		},
+		{
+			name: "seed", token: "secret", seedDirs: []string{seedRoot}, method: "POST", path: "/_admin/seed", auth: "Bearer secret",
+			body: `{"dir": "` + filepath.Join(seedRoot, "debian") + `", "prefix": "/debian"}`, status: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			r := mux.NewRouter()
+			newAdminHandlers(test.token, test.seedDirs, c, newOfflineMode(c, false, false)).register(r)
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if test.auth != "" {
+				req.Header.Set("Authorization", test.auth)
+			}
+			res := httptest.NewRecorder()
+			r.ServeHTTP(res, req)
+			assert.Equal(test.status, res.Code, res.Body.String())
+			assert.Equal("application/json", res.Header().Get("Content-Type"))
+		})
+	}
+
+	entries := c.Entries(cache.EntryFilter{Prefix: "/"})
+	assert.Len(t, entries, 1)
+	data, err := json.Marshal(entries)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "/debian/file")
+}
+
+func TestAdminListenerRequiresToken(t *testing.T) {
+	assert := assert.New(t)
+	c := DefaultConfig()
+	c.ProxyTarget = "http://localhost"
+	c.AdminListenAddr = "localhost:8081"
+	assert.EqualError(c.Validate(), "the admin listener requires an admin token")
+	c.AdminToken = "secret"
+	assert.NoError(c.Validate())
+}
@@ -1,23 +1,378 @@
 package server
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrisvdg/cacheserver/cache"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
 
 // Config represents a server config
+// The yaml tags represent the keys of the config file
 type Config struct {
-	ListenAddr           string
-	TLSListenAddr        string
-	TLSOnly              bool
-	TLS                  *TLSConfig
-	Verbose              bool
-	BackendFile          string
-	CacheDir             string
-	ProxyTarget          string
-	CacheExpiration      time.Duration
-	CacheCleanupInterval time.Duration
+	ListenAddr           string               `yaml:"listen_addr"`
+	TLSListenAddr        string               `yaml:"tls_listen_addr"`
+	TLSOnly              bool                 `yaml:"tls_only"`
+	TLS                  *TLSConfig           `yaml:"tls"`
+	Verbose              bool                 `yaml:"verbose"`
+	BackendFile          string               `yaml:"backend_file"`
+	CacheDir             string               `yaml:"cache_dir"`
+	CacheVolumes         Volumes              `yaml:"cache_volumes"`
+	Placement            string               `yaml:"placement"`
+	DiskHighWatermark    float64              `yaml:"disk_high_watermark"`
+	DiskLowWatermark     float64              `yaml:"disk_low_watermark"`
+	EvictionPolicy       string               `yaml:"eviction_policy"`
+	MinObjectSize        int64                `yaml:"min_object_size"`
+	MaxObjectSize        int64                `yaml:"max_object_size"`
+	ProxyTarget          string               `yaml:"proxy_target"`
+	CacheExpiration      time.Duration        `yaml:"cache_expiration"`
+	CacheCleanupInterval time.Duration        `yaml:"cache_cleanup_interval"`
+	Routes               []*cache.Route       `yaml:"-"`
+	RoutesFile           string               `yaml:"routes_file"`
+	EncryptionKey        []byte               `yaml:"-"`
+	EncryptionKeyFile    string               `yaml:"encryption_key_file"`
+	MemoryCache          cache.MemoryConfig   `yaml:"memory_cache"`
+	AdminListenAddr      string               `yaml:"admin_listen_addr"`
+	Metrics              bool                 `yaml:"metrics"`
+	InternalPrefix       string               `yaml:"internal_prefix"`
+	AdminToken           string               `yaml:"-"`
+	AdminTokenFile       string               `yaml:"admin_token_file"`
+	SeedDirs             []string             `yaml:"seed_dirs"`
+	AccessLog            string               `yaml:"access_log"`
+	AccessLogFormat      string               `yaml:"access_log_format"`
+	ShutdownTimeout      time.Duration        `yaml:"shutdown_timeout"`
+	ReadHeaderTimeout    time.Duration        `yaml:"read_header_timeout"`
+	IdleTimeout          time.Duration        `yaml:"idle_timeout"`
+	WriteTimeout         time.Duration        `yaml:"write_timeout"`
+	Upstream             cache.UpstreamConfig `yaml:"upstream"`
+	Offline              bool                 `yaml:"offline"`
+	AutoOffline          bool                 `yaml:"auto_offline"`
 }
 
 // TLSConfig represents a TLS configuration
 type TLSConfig struct {
-	KeyFile  string
-	CertFile string
+	KeyFile  string `yaml:"key_file"`
+	CertFile string `yaml:"cert_file"`
+}
+
+// DefaultConfig returns the config of the settings that are not provided
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:           ":8080",
+		TLSListenAddr:        ":8443",
+		TLS:                  &TLSConfig{},
+		BackendFile:          "./cachebackend.data",
+		CacheDir:             "./cachebackend",
+		Placement:            cache.PlacementRoundRobin,
+		EvictionPolicy:       cache.EvictLRU,
+		CacheExpiration:      24 * time.Hour,
+		CacheCleanupInterval: 12 * time.Hour,
+		DiskHighWatermark:    90,
+		DiskLowWatermark:     80,
+		MemoryCache: cache.MemoryConfig{
+			MaxObjectSize: 1 << 20,
+			MinHits:       2,
+		},
+		AccessLogFormat:   AccessLogCombined,
+		ShutdownTimeout:   30 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		Upstream: cache.UpstreamConfig{
+			DialTimeout:           10 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			BodyIdleTimeout:       time.Minute,
+		},
+		AutoOffline: true,
+	}
+}
+
+// fileConfig represents the layout of a config file
+type fileConfig struct {
+	Config `yaml:",inline"`
+	// Routes represents the routes in the format of a routes file
+	Routes interface{} `yaml:"routes"`
+}
+
+// LoadConfigFile reads the settings of a YAML config file into the config
+// Settings that are not in the file keep their value
+func LoadConfigFile(file string, c *Config) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read config file")
+	}
+	fc := &fileConfig{Config: *c}
+	if fc.TLS != nil {
+		tls := *fc.TLS
+		fc.TLS = &tls
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(fc)
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "failed to parse config file %s", file)
+	}
+	if fc.Routes != nil {
+		if fc.RoutesFile != "" {
+			return errors.Errorf("config file %s has both routes and a routes file", file)
+		}
+		// routes are decoded like a routes file
+		data, err := json.Marshal(fc.Routes)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse routes of config file %s", file)
+		}
+		fc.Config.Routes = []*cache.Route{}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&fc.Config.Routes)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse routes of config file %s", file)
+		}
+	}
+	*c = fc.Config
+
+	return nil
+}
+
+// LoadFiles reads the routes, encryption key and admin token from the files the config refers to
+func (c *Config) LoadFiles() error {
+	var err error
+	if c.RoutesFile != "" {
+		c.Routes, err = LoadRoutes(c.RoutesFile)
+		if err != nil {
+			return err
+		}
+	}
+	c.EncryptionKey, err = LoadEncryptionKey(c.EncryptionKeyFile)
+	if err != nil {
+		return err
+	}
+	c.AdminToken, err = LoadAdminToken(c.AdminTokenFile)
+
+	return err
+}
+
+// Validate checks if the config is usable without starting the server
+func (c *Config) Validate() error {
+	if c.ProxyTarget == "" {
+		return errors.New("No proxy target provided")
+	}
+	u, err := url.Parse(c.ProxyTarget)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.Errorf("invalid proxy target %s", c.ProxyTarget)
+	}
+	if c.TLSOnly && (c.TLS == nil || c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		return errors.New("serving only TLS requires a TLS certificate and key")
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown timeout can not be negative")
+	}
+	if c.ReadHeaderTimeout < 0 || c.IdleTimeout < 0 || c.WriteTimeout < 0 {
+		return errors.New("server timeouts can not be negative")
+	}
+	if c.AdminListenAddr != "" && c.AdminToken == "" {
+		return errors.New("the admin listener requires an admin token")
+	}
+	if c.InternalPrefix != "" && (!strings.HasPrefix(c.InternalPrefix, "/") || strings.HasSuffix(c.InternalPrefix, "/")) {
+		return errors.Errorf("invalid internal prefix %s, it should start and not end with /", c.InternalPrefix)
+	}
+	err = validAccessLogFormat(c.AccessLogFormat)
+	if err != nil {
+		return err
+	}
+
+	return c.CacheConfig().Validate()
+}
+
+// CacheConfig returns the config of the cache of the server
+func (c *Config) CacheConfig() *cache.Config {
+	return &cache.Config{
+		BackendFile:     c.BackendFile,
+		CacheDir:        c.CacheDir,
+		Volumes:         c.CacheVolumes,
+		Placement:       c.Placement,
+		HighWatermark:   c.DiskHighWatermark,
+		LowWatermark:    c.DiskLowWatermark,
+		EvictionPolicy:  c.EvictionPolicy,
+		MinSize:         c.MinObjectSize,
+		MaxSize:         c.MaxObjectSize,
+		ProxyTarget:     c.ProxyTarget,
+		CacheExpiration: c.CacheExpiration,
+		CleanupInterval: c.CacheCleanupInterval,
+		Routes:          c.Routes,
+		EncryptionKey:   c.EncryptionKey,
+		Memory:          c.MemoryCache,
+		Upstream:        c.Upstream,
+	}
+}
+
+// LoadRoutes reads the cache routes from a JSON file
+func LoadRoutes(file string) ([]*cache.Route, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read routes file")
+	}
+	routes := []*cache.Route{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&routes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse routes file")
+	}
+
+	return routes, nil
+}
+
+// EncryptionKeyEnv represents the environment variable the encryption key is read from
+// if no encryption key file is provided
+const EncryptionKeyEnv = "CACHESERVER_ENCRYPTION_KEY"
+
+// LoadEncryptionKey reads the encryption key from the provided file
+// or from the EncryptionKeyEnv environment variable if no file is provided
+// Returns nil if no key is configured
+func LoadEncryptionKey(file string) ([]byte, error) {
+	var data []byte
+	if file != "" {
+		var err error
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read encryption key file")
+		}
+	} else if env := os.Getenv(EncryptionKeyEnv); env != "" {
+		data = []byte(env)
+	} else {
+		return nil, nil
+	}
+
+	key, err := cache.ParseEncryptionKey(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid encryption key")
+	}
+
+	return key, nil
+}
+
+// AdminTokenEnv represents the environment variable the admin token is read from
+// if no admin token file is provided
+const AdminTokenEnv = "CACHESERVER_ADMIN_TOKEN"
+
+// LoadAdminToken reads the token that authenticates admin requests from the provided file
+// or from the AdminTokenEnv environment variable if no file is provided
+// Returns an empty token if no token is configured
+func LoadAdminToken(file string) (string, error) {
+	if file == "" {
+		return strings.TrimSpace(os.Getenv(AdminTokenEnv)), nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read admin token file")
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("admin token file is empty")
+	}
+
+	return token, nil
+}
+
+// Volumes represents a list of cache volumes
+// Volumes are provided in the format of ParseVolume separated by commas,
+// or in a config file as a list of volumes in the format of ParseVolume or of mappings with a dir and capacity
+type Volumes []*cache.Volume
+
+// UnmarshalText parses a list of volumes separated by commas
+func (v *Volumes) UnmarshalText(text []byte) error {
+	volumes, err := ParseVolumes(string(text))
+	if err != nil {
+		return err
+	}
+	*v = volumes
+
+	return nil
+}
+
+// UnmarshalYAML parses the volumes of a config file
+func (v *Volumes) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return v.UnmarshalText([]byte(node.Value))
+	}
+	if node.Kind != yaml.SequenceNode {
+		return errors.Errorf("line %d: cache volumes should be a list", node.Line)
+	}
+	volumes := Volumes{}
+	for _, item := range node.Content {
+		if item.Kind == yaml.ScalarNode {
+			vols, err := ParseVolumes(item.Value)
+			if err != nil {
+				return errors.Wrapf(err, "line %d", item.Line)
+			}
+			volumes = append(volumes, vols...)
+			continue
+		}
+		vol := &cache.Volume{}
+		err := decodeNodeStrict(item, vol)
+		if err != nil {
+			return errors.Wrapf(err, "line %d", item.Line)
+		}
+		volumes = append(volumes, vol)
+	}
+	*v = volumes
+
+	return nil
+}
+
+// decodeNodeStrict decodes a node of a config file, like the config file unknown keys are rejected
+func decodeNodeStrict(node *yaml.Node, v interface{}) error {
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	return dec.Decode(v)
+}
+
+// ParseVolumes parses lists of volumes separated by commas
+// Every source of volumes is parsed with it: flags, environment variables and config files
+func ParseVolumes(lists ...string) (Volumes, error) {
+	volumes := Volumes{}
+	for _, list := range lists {
+		for _, s := range strings.Split(list, ",") {
+			vol, err := ParseVolume(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			volumes = append(volumes, vol)
+		}
+	}
+
+	return volumes, nil
+}
+
+// ParseVolume parses a cache volume in the format `dir[=capacity in bytes]`
+func ParseVolume(s string) (*cache.Volume, error) {
+	parts := strings.SplitN(s, "=", 2)
+	v := &cache.Volume{Dir: parts[0]}
+	if v.Dir == "" {
+		return nil, errors.Errorf("cache volume %s has no directory", s)
+	}
+	if len(parts) == 2 {
+		capacity, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid capacity of cache volume %s", s)
+		}
+		v.Capacity = capacity
+	}
+
+	return v, nil
 }
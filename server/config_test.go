@@ -0,0 +1,142 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chrisvdg/cacheserver/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		file   string
+		err    string
+		expect func(assert *assert.Assertions, c *Config)
+	}{
+		{
+			name: "empty file keeps the defaults",
+			file: "",
+			expect: func(assert *assert.Assertions, c *Config) {
+				assert.Equal(DefaultConfig(), c)
+			},
+		},
+		{
+			name: "settings",
+			file: "proxy_target: http://localhost\nlisten_addr: :9000\ntls:\n  cert_file: tls.crt\ncache_expiration: 1h\nupstream:\n  dial_timeout: 5s\nseed_dirs: [/srv/a, /srv/b]\n",
+			expect: func(assert *assert.Assertions, c *Config) {
+				assert.Equal("http://localhost", c.ProxyTarget)
+				assert.Equal(":9000", c.ListenAddr)
+				assert.Equal("tls.crt", c.TLS.CertFile)
+				assert.Equal(time.Hour, c.CacheExpiration)
+				assert.Equal(5*time.Second, c.Upstream.DialTimeout)
+				assert.Equal([]string{"/srv/a", "/srv/b"}, c.SeedDirs)
+				// settings that are not in the file keep their value
+				assert.Equal(":8443", c.TLSListenAddr)
+				assert.Equal(DefaultConfig().Upstream.BodyIdleTimeout, c.Upstream.BodyIdleTimeout)
+			},
+		},
+		{
+			name: "cache volumes",
+			file: "cache_volumes:\n  - /mnt/a=10,/mnt/b\n  - dir: /mnt/c\n    capacity: 20\n",
+			expect: func(assert *assert.Assertions, c *Config) {
+				assert.Equal(Volumes{{Dir: "/mnt/a", Capacity: 10}, {Dir: "/mnt/b"}, {Dir: "/mnt/c", Capacity: 20}}, c.CacheVolumes)
+			},
+		},
+		{
+			name: "cache volumes as a string",
+			file: "cache_volumes: /mnt/a=10,/mnt/b\n",
+			expect: func(assert *assert.Assertions, c *Config) {
+				assert.Equal(Volumes{{Dir: "/mnt/a", Capacity: 10}, {Dir: "/mnt/b"}}, c.CacheVolumes)
+			},
+		},
+		{
+			name: "routes",
+			file: "routes:\n  - name: releases\n    prefix: /releases/\n",
+			expect: func(assert *assert.Assertions, c *Config) {
+				assert.Equal([]*cache.Route{{Name: "releases", Prefix: "/releases/"}}, c.Routes)
+			},
+		},
+		{name: "unknown key", file: "proxy_targt: http://localhost\n", err: "field proxy_targt not found"},
+		{name: "unknown nested key", file: "upstream:\n  dial: 5s\n", err: "field dial not found"},
+		{name: "unknown volume key", file: "cache_volumes:\n  - path: /mnt/a\n", err: "field path not found"},
+		{name: "unknown route key", file: "routes:\n  - name: releases\n    prefx: /releases/\n", err: "unknown field"},
+		{name: "setting without a key", file: "encryption_key: secret\n", err: "field encryption_key not found"},
+		{name: "routes and routes file", file: "routes: []\nroutes_file: routes.json\n", err: "both routes and a routes file"},
+		{name: "invalid value", file: "cache_expiration: soon\n", err: "failed to parse config file"},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			file := filepath.Join(dir, string(rune('a'+i))+".yaml")
+			assert.NoError(ioutil.WriteFile(file, []byte(test.file), 0600))
+			c := DefaultConfig()
+			err := LoadConfigFile(file, c)
+			if test.err != "" {
+				if assert.Error(err) {
+					assert.Contains(err.Error(), test.err)
+				}
+				return
+			}
+			assert.NoError(err)
+			test.expect(assert, c)
+		})
+	}
+}
+
+func TestLoadConfigFileDoesNotShareTLS(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	assert.NoError(ioutil.WriteFile(file, []byte("tls:\n  key_file: tls.key\n"), 0600))
+
+	c := DefaultConfig()
+	tls := c.TLS
+	assert.NoError(LoadConfigFile(file, c))
+	assert.Equal("tls.key", c.TLS.KeyFile)
+	assert.Empty(tls.KeyFile)
+}
+
+func TestLoadRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		routes string
+		err    string
+	}{
+		{name: "valid", routes: `[{"name": "releases", "prefix": "/releases/"}]`},
+		{name: "misspelled key", routes: `[{"name": "releases", "prefix": "/releases/", "compresion": true}]`, err: `unknown field "compresion"`},
+		{name: "invalid json", routes: `[{"name": }]`, err: "failed to parse routes file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			file := filepath.Join(dir, "routes.json")
+			assert.NoError(ioutil.WriteFile(file, []byte(test.routes), 0600))
+			routes, err := LoadRoutes(file)
+			if test.err != "" {
+				if assert.Error(err) {
+					assert.Contains(err.Error(), test.err)
+				}
+				return
+			}
+			assert.NoError(err)
+			if assert.Len(routes, 1) {
+				assert.Equal("releases", routes[0].Name)
+			}
+		})
+	}
+}
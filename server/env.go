@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EnvPrefix represents the prefix of the environment variables the config is read from
+const EnvPrefix = "CACHESERVER_"
+
+// ConfigFileEnv represents the environment variable the config file is read from if no config file is provided
+const ConfigFileEnv = EnvPrefix + "CONFIG"
+
+// LoadConfig returns the config of the defaults, the config file, the environment variables and the flags,
+// each overriding the settings of the previous ones
+// The config file is read from the ConfigFileEnv environment variable if no file is provided
+// flags applies the flags that were provided to the config
+func LoadConfig(file string, flags func(c *Config) error) (*Config, error) {
+	c := DefaultConfig()
+	if file == "" {
+		file = os.Getenv(ConfigFileEnv)
+	}
+	if file != "" {
+		err := LoadConfigFile(file, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := LoadEnv(c)
+	if err != nil {
+		return nil, err
+	}
+	if flags != nil {
+		err = flags(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// LoadEnv reads the settings of the environment variables into the config
+// Every setting of the config file is read from the environment variable named after its key,
+// eg: proxy_target from CACHESERVER_PROXY_TARGET and the cert_file of tls from CACHESERVER_TLS_CERT_FILE
+// Settings of which the environment variable is not set or empty keep their value
+func LoadEnv(c *Config) error {
+	return loadEnv(reflect.ValueOf(c).Elem(), EnvPrefix)
+}
+
+// loadEnv reads the fields of a struct with a yaml key from the environment variables with the prefix
+func loadEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		f := v.Field(i)
+		if f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct {
+			if f.IsNil() {
+				f.Set(reflect.New(f.Type().Elem()))
+			}
+			f = f.Elem()
+		}
+		if f.Kind() == reflect.Struct {
+			err := loadEnv(f, name+"_")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		err := setEnvValue(f, value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid value of environment variable %s", name)
+		}
+	}
+
+	return nil
+}
+
+// setEnvValue parses the value of an environment variable like the flag of the setting
+func setEnvValue(v reflect.Value, value string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return errors.Errorf("settings of type %s are not supported", v.Type())
+		}
+		items := strings.Split(value, ",")
+		for i := range items {
+			items[i] = strings.TrimSpace(items[i])
+		}
+		v.Set(reflect.ValueOf(items).Convert(v.Type()))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return errors.Errorf("settings of type %s are not supported", v.Type())
+	}
+
+	return nil
+}
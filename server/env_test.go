@@ -0,0 +1,170 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setEnv sets environment variables and returns a function that unsets them
+func setEnv(t *testing.T, env map[string]string) func() {
+	for name, value := range env {
+		assert.NoError(t, os.Setenv(name, value))
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// envSettings adds the environment variable of every setting of the config file to env
+// with a value that differs from the default of the setting
+func envSettings(v reflect.Value, prefix string, env map[string]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		f := v.Field(i)
+		if f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct {
+			f = f.Elem()
+		}
+		if f.Kind() == reflect.Struct {
+			envSettings(f, name+"_", env)
+			continue
+		}
+
+		switch {
+		case f.Type() == reflect.TypeOf(Volumes{}):
+			env[name] = "/mnt/env=1"
+		case f.Type() == reflect.TypeOf(time.Duration(0)):
+			env[name] = "7m"
+		case f.Kind() == reflect.Bool:
+			env[name] = "true"
+			if f.Bool() {
+				env[name] = "false"
+			}
+		case f.Kind() == reflect.Slice:
+			env[name] = "env1, env2"
+		case f.Kind() == reflect.String:
+			env[name] = "env"
+		default:
+			env[name] = "7"
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	assert := assert.New(t)
+	env := map[string]string{}
+	envSettings(reflect.ValueOf(DefaultConfig()).Elem(), EnvPrefix, env)
+	assert.Contains(env, "CACHESERVER_PROXY_TARGET")
+	assert.Contains(env, "CACHESERVER_TLS_CERT_FILE")
+	assert.Contains(env, "CACHESERVER_UPSTREAM_BODY_IDLE_TIMEOUT")
+	assert.Contains(env, "CACHESERVER_MEMORY_CACHE_MIN_HITS")
+	defer setEnv(t, env)()
+
+	c := DefaultConfig()
+	assert.NoError(LoadEnv(c))
+	// every setting of the config file changed
+	defaults := reflect.ValueOf(DefaultConfig()).Elem()
+	var compare func(v, d reflect.Value, prefix string)
+	compare = func(v, d reflect.Value, prefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			key := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			if key == "" || key == "-" {
+				continue
+			}
+			f, df := reflect.Indirect(v.Field(i)), reflect.Indirect(d.Field(i))
+			if f.Kind() == reflect.Struct {
+				compare(f, df, prefix+key+".")
+				continue
+			}
+			assert.NotEqual(df.Interface(), f.Interface(), prefix+key)
+		}
+	}
+	compare(reflect.ValueOf(c).Elem(), defaults, "")
+	assert.Equal([]string{"env1", "env2"}, c.SeedDirs)
+	assert.Equal(Volumes{{Dir: "/mnt/env", Capacity: 1}}, c.CacheVolumes)
+}
+
+func TestLoadEnvInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "CACHESERVER_CACHE_EXPIRATION", value: "soon"},
+		{name: "CACHESERVER_OFFLINE", value: "maybe"},
+		{name: "CACHESERVER_MAX_OBJECT_SIZE", value: "big"},
+		{name: "CACHESERVER_DISK_HIGH_WATERMARK", value: "high"},
+		{name: "CACHESERVER_CACHE_VOLUMES", value: "/mnt/a=lots"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			defer setEnv(t, map[string]string{test.name: test.value})()
+			err := LoadEnv(DefaultConfig())
+			if assert.Error(err) {
+				assert.Contains(err.Error(), test.name)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("listen_addr: :1000\ncache_volumes: /mnt/file\n"), 0600))
+	envFile := filepath.Join(dir, "env.yaml")
+	assert.NoError(t, ioutil.WriteFile(envFile, []byte("listen_addr: :4000\n"), 0600))
+
+	flags := func(c *Config) (err error) {
+		c.ListenAddr = ":3000"
+		c.CacheVolumes, err = ParseVolumes("/mnt/flag")
+		return err
+	}
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		flags   func(c *Config) error
+		addr    string
+		volumes Volumes
+	}{
+		{name: "defaults", addr: ":8080"},
+		{name: "file", file: file, addr: ":1000", volumes: Volumes{{Dir: "/mnt/file"}}},
+		{name: "config file env", env: map[string]string{ConfigFileEnv: envFile}, addr: ":4000"},
+		{name: "config file flag over env", file: file, env: map[string]string{ConfigFileEnv: envFile}, addr: ":1000", volumes: Volumes{{Dir: "/mnt/file"}}},
+		{
+			name: "env over file", file: file,
+			env:  map[string]string{"CACHESERVER_LISTEN_ADDR": ":2000", "CACHESERVER_CACHE_VOLUMES": "/mnt/env"},
+			addr: ":2000", volumes: Volumes{{Dir: "/mnt/env"}},
+		},
+		{
+			name: "flags over env", file: file, flags: flags,
+			env:  map[string]string{"CACHESERVER_LISTEN_ADDR": ":2000", "CACHESERVER_CACHE_VOLUMES": "/mnt/env"},
+			addr: ":3000", volumes: Volumes{{Dir: "/mnt/flag"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			defer setEnv(t, test.env)()
+			c, err := LoadConfig(test.file, test.flags)
+			assert.NoError(err)
+			assert.Equal(test.addr, c.ListenAddr)
+			assert.Equal(test.volumes, c.CacheVolumes)
+		})
+	}
+}
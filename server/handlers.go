@@ -5,24 +5,29 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"time"
 
 	"github.com/chrisvdg/cacheserver/cache"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-func newHandlers(target string, cache *cache.Cache) *handlers {
+func newHandlers(target string, upstream cache.UpstreamConfig, c *cache.Cache, metrics *metrics) *handlers {
 	return &handlers{
 		proxyBaseURL: target,
-		http:         &http.Client{},
-		backend:      cache,
+		http:         cache.NewUpstreamClient(upstream),
+		bodyTimeout:  upstream.BodyIdleTimeout,
+		backend:      c,
+		metrics:      metrics,
 	}
 }
 
 type handlers struct {
 	proxyBaseURL string
 	http         *http.Client
+	bodyTimeout  time.Duration
 	backend      *cache.Cache
+	metrics      *metrics
 }
 
 func (h *handlers) CacheHandler(res http.ResponseWriter, req *http.Request) {
@@ -50,18 +55,25 @@ func (h *handlers) getProxyURL(reqPath string) (string, error) {
 }
 
 func (h *handlers) proxy(res http.ResponseWriter, req *http.Request) {
+	if h.backend.Offline() {
+		h.backend.WriteOfflineMiss(res, req)
+		return
+	}
 	targetURL, err := h.getProxyURL(req.URL.Path)
 	if err != nil {
 		h.handleError(res, req, err)
 		return
 	}
-	targetReq, err := http.NewRequest(req.Method, targetURL, req.Body)
+	targetReq, err := http.NewRequestWithContext(req.Context(), req.Method, targetURL, req.Body)
 	if err != nil {
 		h.handleError(res, req, err)
 		return
 	}
 
 	targetReq.URL.RawQuery = req.URL.RawQuery
+	if info := cache.GetRequestInfo(req); info != nil {
+		info.Upstream = targetReq.URL.Host
+	}
 
 	for name, values := range req.Header {
 		for _, v := range values {
@@ -71,18 +83,29 @@ func (h *handlers) proxy(res http.ResponseWriter, req *http.Request) {
 
 	targetResp, err := h.http.Do(targetReq)
 	if err != nil {
-		h.handleError(res, req, errors.Wrap(err, "target request failed"))
+		log.Errorf("Target request failed: %s", err)
+		res.WriteHeader(http.StatusBadGateway)
+		return
 	}
-	defer targetResp.Body.Close()
+	body := cache.NewStallReader(targetResp.Body, h.bodyTimeout)
+	defer body.Close()
 
 	for name, values := range targetResp.Header {
 		for _, v := range values {
 			res.Header().Add(name, v)
 		}
 	}
+	cache.SetBypassHeaders(res, req)
 	res.WriteHeader(targetResp.StatusCode)
 
-	io.Copy(res, targetResp.Body)
+	n, err := io.Copy(res, body)
+	h.metrics.upstreamRead(h.backend.RouteName(req.URL.Path), n)
+	if errors.Cause(err) == cache.ErrUpstreamStalled {
+		log.Errorf("Target request failed: %s", err)
+		// the response has already been started,
+		// abort it so the client does not mistake a truncated body for a valid one
+		panic(http.ErrAbortHandler)
+	}
 }
 
 func (h *handlers) cache(res http.ResponseWriter, req *http.Request) {
@@ -93,5 +116,15 @@ func (h *handlers) cache(res http.ResponseWriter, req *http.Request) {
 	}
 	if err != nil {
 		log.Errorf("Failed to perform cache request: %s", err)
+		if errors.Cause(err) == cache.ErrTargetUnreachable {
+			res.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if errors.Cause(err) == cache.ErrReadFailed || responseStarted(res) {
+			// the response has already been started,
+			// abort it so the client does not mistake a failed body for a valid one
+			panic(http.ErrAbortHandler)
+		}
+		res.WriteHeader(http.StatusInternalServerError)
 	}
 }
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chrisvdg/cacheserver/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineHandlers(t *testing.T) {
+	var requests int32
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		res.Write([]byte("upstream"))
+	}))
+	defer target.Close()
+	c, _, clean := newTestCache(t, target.URL)
+	defer clean()
+	defer c.Close(context.Background())
+	h := newHandlers(target.URL, cache.UpstreamConfig{}, c, newMetrics(c))
+
+	tests := []struct {
+		name     string
+		offline  bool
+		method   string
+		status   int
+		xCache   string
+		body     string
+		requests int32
+	}{
+		{name: "get", offline: true, method: "GET", status: http.StatusGatewayTimeout, xCache: "MISS", body: "cache miss: GET /foo"},
+		{name: "post", offline: true, method: "POST", status: http.StatusGatewayTimeout, xCache: "BYPASS", body: "cache miss: POST /foo"},
+		{name: "delete", offline: true, method: "DELETE", status: http.StatusGatewayTimeout, xCache: "BYPASS", body: "cache miss: DELETE /foo"},
+		{name: "post online", method: "POST", status: http.StatusOK, xCache: "BYPASS", body: "upstream", requests: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			atomic.StoreInt32(&requests, 0)
+			c.SetOffline(test.offline)
+			handler := h.ProxyHandler
+			if test.method == "GET" {
+				handler = h.CacheHandler
+			}
+			res := httptest.NewRecorder()
+			handler(res, httptest.NewRequest(test.method, "/foo", strings.NewReader("body")))
+			assert.Equal(test.status, res.Code)
+			assert.Equal(test.xCache, res.Header().Get("X-Cache"))
+			assert.Contains(res.Body.String(), test.body)
+			assert.Equal(test.requests, atomic.LoadInt32(&requests))
+			if test.offline {
+				assert.Contains(res.Header().Get("Cache-Status"), "detail=offline")
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chrisvdg/cacheserver/cache"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	upstreamCheckInterval = 10 * time.Second
+	upstreamCheckTimeout  = 5 * time.Second
+)
+
+var (
+	errUpstreamNotChecked = errors.New("proxy target has not been checked yet")
+)
+
+// upstreamMonitor periodically checks if the proxy target is reachable
+type upstreamMonitor struct {
+	target string
+	http   *http.Client
+	m      sync.Mutex
+	err    error
+	// onCheck is called with the result of every check
+	onCheck func(err error)
+}
+
+func newUpstreamMonitor(target string) *upstreamMonitor {
+	return &upstreamMonitor{
+		target: target,
+		http:   &http.Client{Timeout: upstreamCheckTimeout},
+		err:    errUpstreamNotChecked,
+	}
+}
+
+// run checks the proxy target until the context is done
+func (u *upstreamMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(upstreamCheckInterval)
+	defer ticker.Stop()
+	for {
+		u.check()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check checks if the proxy target responds, any response counts as reachable
+func (u *upstreamMonitor) check() {
+	resp, err := u.http.Head(u.target)
+	if err == nil {
+		resp.Body.Close()
+	} else {
+		err = errors.Wrap(err, "proxy target is unreachable")
+	}
+
+	u.m.Lock()
+	defer u.m.Unlock()
+	wasReachable := u.err == nil || u.err == errUpstreamNotChecked
+	if err != nil && wasReachable {
+		log.Warn(err)
+	} else if err == nil && !wasReachable {
+		log.Info("Proxy target is reachable again")
+	}
+	u.err = err
+	if u.onCheck != nil {
+		u.onCheck(err)
+	}
+}
+
+// status returns the error of the last check, nil if the proxy target was reachable
+func (u *upstreamMonitor) status() error {
+	u.m.Lock()
+	defer u.m.Unlock()
+	return u.err
+}
+
+// healthHandlers serves the liveness and readiness probes
+type healthHandlers struct {
+	cache    *cache.Cache
+	upstream *upstreamMonitor
+}
+
+// checkResult represents the result of a readiness check
+type checkResult struct {
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// register adds the probe endpoints to the router
+func (h *healthHandlers) register(r *mux.Router) {
+	r.HandleFunc("/healthz", h.healthz).Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", h.readyz).Methods("GET", "HEAD")
+}
+
+// healthz reports that the process is alive
+func (h *healthHandlers) healthz(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports if the server can serve requests, with the result of every check
+func (h *healthHandlers) readyz(res http.ResponseWriter, req *http.Request) {
+	checks := map[string]error{
+		"cache_dir": h.cache.CheckStorage(),
+		"metadata":  h.cache.CheckMetadata(),
+		"disk":      nil,
+		"upstream":  h.upstream.status(),
+	}
+	if h.cache.PassThrough() {
+		checks["disk"] = errors.New("all cache volumes are over the high disk watermark")
+	}
+
+	status := http.StatusOK
+	results := map[string]*checkResult{}
+	for name, err := range checks {
+		results[name] = &checkResult{OK: err == nil}
+		if err != nil {
+			results[name].Error = err.Error()
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if checks["upstream"] != nil && h.cache.Offline() {
+		// the cache serves requests without the proxy target
+		results["upstream"].Detail = "ignored in offline mode"
+		if checks["cache_dir"] == nil && checks["metadata"] == nil && checks["disk"] == nil {
+			status = http.StatusOK
+		}
+	}
+	ready := "ready"
+	if status != http.StatusOK {
+		ready = "not ready"
+	}
+	writeJSON(res, status, map[string]interface{}{
+		"status": ready,
+		"checks": results,
+	})
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readiness represents a response of the readiness probe
+type readiness struct {
+	Status string                  `json:"status"`
+	Checks map[string]*checkResult `json:"checks"`
+}
+
+func TestReadyzTransitions(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	down.Close()
+
+	c, dir, clean := newTestCache(t, up.URL)
+	defer clean()
+	defer c.Close(context.Background())
+	upstream := newUpstreamMonitor(up.URL)
+	offline := newOfflineMode(c, false, false)
+	upstream.onCheck = offline.setUpstreamError
+	h := &healthHandlers{cache: c, upstream: upstream}
+
+	steps := []struct {
+		name   string
+		apply  func()
+		status int
+		failed []string
+		detail string
+	}{
+		{name: "upstream not checked", apply: func() {}, status: http.StatusServiceUnavailable, failed: []string{"upstream"}},
+		{name: "upstream reachable", apply: upstream.check, status: http.StatusOK},
+		{
+			name: "upstream unreachable",
+			apply: func() {
+				upstream.target = down.URL
+				upstream.check()
+			},
+			status: http.StatusServiceUnavailable,
+			failed: []string{"upstream"},
+		},
+		{
+			name:   "auto offline",
+			apply:  func() { offline.configure(false, true) },
+			status: http.StatusOK,
+			failed: []string{"upstream"},
+			detail: "ignored in offline mode",
+		},
+		{
+			name: "upstream reachable again",
+			apply: func() {
+				upstream.target = up.URL
+				upstream.check()
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "cache dir not writable",
+			apply: func() {
+				cacheDir := filepath.Join(dir, "cache")
+				assert.NoError(t, os.RemoveAll(cacheDir))
+				assert.NoError(t, ioutil.WriteFile(cacheDir, nil, 0600))
+			},
+			status: http.StatusServiceUnavailable,
+			failed: []string{"cache_dir"},
+		},
+		{
+			name:   "cache dir not writable in offline mode",
+			apply:  func() { offline.configure(true, true) },
+			status: http.StatusServiceUnavailable,
+			failed: []string{"cache_dir"},
+		},
+	}
+	for _, step := range steps {
+		assert := assert.New(t)
+		step.apply()
+		res := httptest.NewRecorder()
+		h.readyz(res, httptest.NewRequest("GET", "/readyz", nil))
+		assert.Equal(step.status, res.Code, step.name)
+
+		r := &readiness{}
+		assert.NoError(json.Unmarshal(res.Body.Bytes(), r), step.name)
+		if step.status == http.StatusOK {
+			assert.Equal("ready", r.Status, step.name)
+		} else {
+			assert.Equal("not ready", r.Status, step.name)
+		}
+		failed := []string{}
+		for name, result := range r.Checks {
+			if !result.OK {
+				failed = append(failed, name)
+			}
+		}
+		if len(step.failed) == 0 {
+			assert.Empty(failed, step.name)
+		} else {
+			assert.ElementsMatch(step.failed, failed, step.name)
+		}
+		assert.Equal(step.detail, r.Checks["upstream"].Detail, step.name)
+	}
+
+	res := httptest.NewRecorder()
+	h.healthz(res, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+}
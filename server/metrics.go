@@ -0,0 +1,198 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chrisvdg/cacheserver/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultRoute represents the route label of requests that match no route
+const defaultRoute = "default"
+
+// metrics represents the Prometheus metrics of the server
+type metrics struct {
+	cache         *cache.Cache
+	registry      *prometheus.Registry
+	requests      *prometheus.CounterVec
+	responseBytes *prometheus.CounterVec
+	upstreamBytes *prometheus.CounterVec
+	requestErrors *prometheus.CounterVec
+	fills         *prometheus.CounterVec
+	fillBytes     *prometheus.CounterVec
+	ttfb          *prometheus.HistogramVec
+	duration      *prometheus.HistogramVec
+}
+
+func newMetrics(c *cache.Cache) *metrics {
+	m := &metrics{
+		cache:    c,
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cacheserver_requests_total",
+			Help: "Requests per route and cache outcome (hit, stale, miss, coalesced or bypass).",
+		}, []string{"route", "outcome"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cacheserver_response_bytes_total",
+			Help: "Bytes of response bodies per route and cache outcome, bytes served from cache have outcome hit.",
+		}, []string{"route", "outcome"}),
+		upstreamBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cacheserver_upstream_bytes_total",
+			Help: "Bytes read from the proxy target per route.",
+		}, []string{"route"}),
+		requestErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cacheserver_request_errors_total",
+			Help: "Requests per route that were aborted or answered with a server error.",
+		}, []string{"route"}),
+		fills: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cacheserver_fills_total",
+			Help: "Entries stored in the cache per route and source (download, refresh, seed or import).",
+		}, []string{"route", "source"}),
+		fillBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cacheserver_fill_bytes_total",
+			Help: "Uncompressed bytes of the entries stored in the cache per route and source.",
+		}, []string{"route", "source"}),
+		ttfb: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cacheserver_time_to_first_byte_seconds",
+			Help:    "Time until the response headers are written per route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cacheserver_request_duration_seconds",
+			Help:    "Time until the response is written per route.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+		}, []string{"route"}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.responseBytes,
+		m.upstreamBytes,
+		m.requestErrors,
+		m.fills,
+		m.fillBytes,
+		m.ttfb,
+		m.duration,
+		&cacheCollector{cache: c},
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// upstreamRead counts bytes read from the proxy target
+func (m *metrics) upstreamRead(route string, n int64) {
+	if n > 0 {
+		m.upstreamBytes.WithLabelValues(routeLabel(route)).Add(float64(n))
+	}
+}
+
+// outcome counts a request the cache decided the outcome of
+func (m *metrics) outcome(route string, outcome cache.Outcome) {
+	m.requests.WithLabelValues(routeLabel(route), outcomeLabel(outcome)).Inc()
+}
+
+// fill counts an entry stored in the cache
+func (m *metrics) fill(route string, source cache.FillSource, size int64) {
+	m.fills.WithLabelValues(routeLabel(route), string(source)).Inc()
+	m.fillBytes.WithLabelValues(routeLabel(route), string(source)).Add(float64(size))
+}
+
+// observe records the metrics of a served request
+// The outcomes of the requests the cache handled are counted by the cache
+func (m *metrics) observe(req *http.Request, w *responseRecorder, info *cache.RequestInfo, aborted bool) {
+	route := routeLabel(m.cache.RouteName(req.URL.Path))
+	if info.Outcome == "" {
+		m.requests.WithLabelValues(route, outcomeLabel(cache.OutcomeBypass)).Inc()
+	}
+	if aborted || w.status >= http.StatusInternalServerError {
+		m.requestErrors.WithLabelValues(route).Inc()
+	}
+	m.responseBytes.WithLabelValues(route, outcomeLabel(requestOutcome(info))).Add(float64(w.written))
+	if !w.firstByte.IsZero() {
+		m.ttfb.WithLabelValues(route).Observe(w.firstByte.Sub(w.start).Seconds())
+	}
+	m.duration.WithLabelValues(route).Observe(time.Since(w.start).Seconds())
+}
+
+// outcomeLabel returns the outcome label of a cache outcome
+func outcomeLabel(outcome cache.Outcome) string {
+	return strings.ToLower(string(outcome))
+}
+
+// routeLabel returns the route label of a route name
+func routeLabel(route string) string {
+	if route == "" {
+		return defaultRoute
+	}
+	return route
+}
+
+// cacheCollector collects the gauges of the cache state at scrape time
+type cacheCollector struct {
+	cache *cache.Cache
+}
+
+var (
+	entriesDesc = prometheus.NewDesc("cacheserver_entries",
+		"Cache entries per state, the in progress state represents downloads in progress.", []string{"state"}, nil)
+	cachedBytesDesc = prometheus.NewDesc("cacheserver_cached_bytes",
+		"Uncompressed size of the cached entries.", nil, nil)
+	volumeUsedDesc = prometheus.NewDesc("cacheserver_volume_used_bytes",
+		"Bytes used by cache files per cache volume.", []string{"volume"}, nil)
+	volumeCapacityDesc = prometheus.NewDesc("cacheserver_volume_capacity_bytes",
+		"Configured capacity per cache volume, 0 if the volume is bounded by its disk.", []string{"volume"}, nil)
+	memoryBytesDesc = prometheus.NewDesc("cacheserver_memory_bytes",
+		"Bytes of entries held in the memory tier.", nil, nil)
+	passThroughDesc = prometheus.NewDesc("cacheserver_pass_through",
+		"1 if all cache volumes are full and requests are proxied without caching.", nil, nil)
+	offlineDesc = prometheus.NewDesc("cacheserver_offline",
+		"1 if requests are only served from the cache without contacting the proxy target.", nil, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- entriesDesc
+	ch <- cachedBytesDesc
+	ch <- volumeUsedDesc
+	ch <- volumeCapacityDesc
+	ch <- memoryBytesDesc
+	ch <- passThroughDesc
+	ch <- offlineDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+	for _, state := range []cache.State{cache.StateInit, cache.StateInProgress, cache.StateCached, cache.StateNoCache} {
+		ch <- prometheus.MustNewConstMetric(entriesDesc, prometheus.GaugeValue, float64(stats.States[state]), string(state))
+	}
+	ch <- prometheus.MustNewConstMetric(cachedBytesDesc, prometheus.GaugeValue, float64(stats.CachedSize))
+	for _, v := range stats.Volumes {
+		ch <- prometheus.MustNewConstMetric(volumeUsedDesc, prometheus.GaugeValue, float64(v.Used), v.Dir)
+		ch <- prometheus.MustNewConstMetric(volumeCapacityDesc, prometheus.GaugeValue, float64(v.Capacity), v.Dir)
+	}
+	var memory float64
+	if stats.Memory != nil {
+		memory = float64(stats.Memory.Size)
+	}
+	ch <- prometheus.MustNewConstMetric(memoryBytesDesc, prometheus.GaugeValue, memory)
+	var passThrough float64
+	if stats.PassThrough {
+		passThrough = 1
+	}
+	ch <- prometheus.MustNewConstMetric(passThroughDesc, prometheus.GaugeValue, passThrough)
+	var offline float64
+	if stats.Offline {
+		offline = 1
+	}
+	ch <- prometheus.MustNewConstMetric(offlineDesc, prometheus.GaugeValue, offline)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/chrisvdg/cacheserver/cache"
+)
+
+// offlineMode decides if the cache is in offline mode
+// The cache is offline if offline mode is switched on manually,
+// or if automatic offline mode is enabled and the proxy target is unreachable
+type offlineMode struct {
+	cache       *cache.Cache
+	m           sync.Mutex
+	manual      bool
+	auto        bool
+	unreachable bool
+}
+
+// offlineStatus represents the state of the offline mode
+type offlineStatus struct {
+	Offline     bool `json:"offline"`
+	Manual      bool `json:"manual"`
+	Auto        bool `json:"auto"`
+	Unreachable bool `json:"upstream_unreachable"`
+}
+
+func newOfflineMode(c *cache.Cache, manual, auto bool) *offlineMode {
+	o := &offlineMode{
+		cache:  c,
+		manual: manual,
+		auto:   auto,
+	}
+	o.apply()
+
+	return o
+}
+
+// configure sets the manual offline mode and if the cache goes offline automatically
+func (o *offlineMode) configure(manual, auto bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.manual = manual
+	o.auto = auto
+	o.apply()
+}
+
+// update changes the provided settings of the offline mode
+func (o *offlineMode) update(manual, auto *bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if manual != nil {
+		o.manual = *manual
+	}
+	if auto != nil {
+		o.auto = *auto
+	}
+	o.apply()
+}
+
+// setUpstreamError records the result of a check of the proxy target
+func (o *offlineMode) setUpstreamError(err error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.unreachable = err != nil && err != errUpstreamNotChecked
+	o.apply()
+}
+
+// status returns the state of the offline mode
+func (o *offlineMode) status() *offlineStatus {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return &offlineStatus{
+		Offline:     o.cache.Offline(),
+		Manual:      o.manual,
+		Auto:        o.auto,
+		Unreachable: o.unreachable,
+	}
+}
+
+// apply switches the cache to the offline mode of the current state
+// Make sure to execute this when the offline mode is locked
+func (o *offlineMode) apply() {
+	o.cache.SetOffline(o.manual || o.auto && o.unreachable)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadOnSignal loads the config again whenever the process receives a reload signal
+func (s *Server) reloadOnSignal(ctx context.Context) {
+	if s.load == nil || len(reloadSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, reloadSignals...)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Info("Reloading config")
+			c, err := s.load()
+			if err == nil {
+				err = s.Reload(c)
+			}
+			if err != nil {
+				log.Errorf("Failed to reload config, keeping the current config: %s", err)
+			}
+		}
+	}
+}
+
+// Reload applies the routes, cache expiration, offline mode and logging settings of a config to the running server
+// Downloads in progress are not interrupted, the other settings are applied on restart
+func (s *Server) Reload(c *Config) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+	err = s.cache.Reconfigure(c.Routes, c.CacheExpiration)
+	if err != nil {
+		return err
+	}
+	err = s.accessLog.configure(c.AccessLog, c.AccessLogFormat)
+	if err != nil {
+		return err
+	}
+	if c.Offline != s.c.Offline || c.AutoOffline != s.c.AutoOffline {
+		// keep the offline mode that was set through the admin endpoint if the config did not change it
+		s.offline.configure(c.Offline, c.AutoOffline)
+	}
+	if c.Verbose {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	applied := *s.c
+	applied.Routes = c.Routes
+	applied.RoutesFile = c.RoutesFile
+	applied.CacheExpiration = c.CacheExpiration
+	applied.Verbose = c.Verbose
+	applied.AccessLog = c.AccessLog
+	applied.AccessLogFormat = c.AccessLogFormat
+	applied.Offline = c.Offline
+	applied.AutoOffline = c.AutoOffline
+	if !reflect.DeepEqual(&applied, c) {
+		log.Warn("Only routes, cache expiration, offline mode and logging settings are reloaded, restart to apply the other changes")
+	}
+	s.c = &applied
+	log.Info("Reloaded config")
+
+	return nil
+}
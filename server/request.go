@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/chrisvdg/cacheserver/cache"
+)
+
+// requestObserver is called for every request once it is served
+type requestObserver func(req *http.Request, w *responseRecorder, info *cache.RequestInfo, aborted bool)
+
+// instrument records how the requests served by next are served and passes them to the observers
+func instrument(next http.HandlerFunc, observers ...requestObserver) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		info := &cache.RequestInfo{}
+		w := newResponseRecorder(res)
+		aborted := true
+		defer func() {
+			for _, observe := range observers {
+				observe(req, w, info, aborted)
+			}
+		}()
+		next(w, cache.WithRequestInfo(req, info))
+		aborted = false
+	}
+}
+
+// requestOutcome returns how the cache served a request
+// Requests the cache did not handle are proxied without caching them
+func requestOutcome(info *cache.RequestInfo) cache.Outcome {
+	if info.Outcome == "" {
+		return cache.OutcomeBypass
+	}
+	return info.Outcome
+}
+
+// responseRecorder records the status, size and timing of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	written   int64
+	start     time.Time
+	firstByte time.Time
+}
+
+func newResponseRecorder(res http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{
+		ResponseWriter: res,
+		status:         http.StatusOK,
+		start:          time.Now(),
+	}
+}
+
+// responseStarted checks if the headers of a response have been written
+// Responses that are not recorded are assumed to not have been started
+func responseStarted(res http.ResponseWriter) bool {
+	r, ok := res.(*responseRecorder)
+	return ok && !r.firstByte.IsZero()
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.firstByte.IsZero() {
+		r.status = status
+		r.firstByte = time.Now()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.firstByte.IsZero() {
+		r.firstByte = time.Now()
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
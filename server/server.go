@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
 
 	"github.com/chrisvdg/cacheserver/cache"
 	"github.com/gorilla/mux"
@@ -18,69 +21,197 @@ func New(c *Config) (*Server, error) {
 		return nil, errors.New("No proxy target provided")
 	}
 
-	err := testTarget(c.ProxyTarget)
+	var m *metrics
+	cc := c.CacheConfig()
+	cc.OnUpstreamRead = func(route string, n int64) {
+		m.upstreamRead(route, n)
+	}
+	cc.OnOutcome = func(route string, outcome cache.Outcome) {
+		m.outcome(route, outcome)
+	}
+	cc.OnFill = func(route string, source cache.FillSource, size int64) {
+		m.fill(route, source, size)
+	}
+	cache, err := cache.New(cc)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to connect to proxy target")
+		return nil, err
 	}
-	cache, err := cache.New(c.BackendFile, c.CacheDir, c.ProxyTarget, 0, c.CacheExpiration, c.CacheCleanupInterval)
+	m = newMetrics(cache)
+
+	accessLog, err := newAccessLog(c.AccessLog, c.AccessLogFormat)
 	if err != nil {
 		return nil, err
 	}
 
+	offline := newOfflineMode(cache, c.Offline, c.AutoOffline)
+	upstream := newUpstreamMonitor(c.ProxyTarget)
+	upstream.onCheck = offline.setUpstreamError
+
 	return &Server{
-		c:     c,
-		cache: cache,
+		c:         c,
+		cache:     cache,
+		metrics:   m,
+		accessLog: accessLog,
+		upstream:  upstream,
+		offline:   offline,
 	}, nil
 }
 
 // Server represents a server instance
 type Server struct {
-	c     *Config
-	cache *cache.Cache
+	c         *Config
+	cache     *cache.Cache
+	metrics   *metrics
+	accessLog *accessLog
+	upstream  *upstreamMonitor
+	offline   *offlineMode
+	load      func() (*Config, error)
+}
+
+// SetLoader sets the function the config is loaded with again when the process receives a reload signal
+func (s *Server) SetLoader(load func() (*Config, error)) {
+	s.load = load
 }
 
 // ListenAndServe listens for new requests and serves them
 func (s *Server) ListenAndServe() {
-	r := mux.NewRouter()
-	h := newHandlers(s.c.ProxyTarget, s.cache)
-
-	r.PathPrefix("/").HandlerFunc(h.CacheHandler).Methods("GET")
-	r.PathPrefix("/").HandlerFunc(h.ProxyHandler)
+	r, adminRouter := s.routers()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	go s.upstream.run(ctx)
+	go s.accessLog.reopenOnSignal(ctx)
+	go s.reloadOnSignal(ctx)
+
+	servers := []*http.Server{}
 	tlsEnabled := s.c.TLS.CertFile != "" && s.c.TLS.KeyFile != ""
 	if !s.c.TLSOnly {
-		go listenAndServe(ctx, cancel, s.c.ListenAddr, r)
+		srv := s.newHTTPServer(s.c.ListenAddr, r)
+		servers = append(servers, srv)
+		go listenAndServe(cancel, srv)
 	}
 
 	if tlsEnabled {
-		go listenAndServeTLS(ctx, cancel, s.c.TLSListenAddr, s.c.TLS, r)
+		srv := s.newHTTPServer(s.c.TLSListenAddr, r)
+		servers = append(servers, srv)
+		go listenAndServeTLS(cancel, srv, s.c.TLS)
+	}
+
+	if adminRouter != nil {
+		srv := s.newHTTPServer(s.c.AdminListenAddr, adminRouter)
+		servers = append(servers, srv)
+		go listenAndServe(cancel, srv)
 	}
 
-	<-ctx.Done()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	defer signal.Stop(signals)
+	select {
+	case sig := <-signals:
+		log.Infof("Received %s, shutting down", sig)
+	case <-ctx.Done():
+		log.Info("Shutting down")
+	}
+	s.shutdown(servers)
+}
+
+// routers returns the router of the http listeners and the router of the admin listener
+// The admin router is nil if no admin listener is configured
+func (s *Server) routers() (*mux.Router, *mux.Router) {
+	r := mux.NewRouter()
+	h := newHandlers(s.c.ProxyTarget, s.c.Upstream, s.cache, s.metrics)
+
+	admin := newAdminHandlers(s.c.AdminToken, s.c.SeedDirs, s.cache, s.offline)
+	var adminRouter *mux.Router
+	if s.c.AdminListenAddr != "" {
+		adminRouter = mux.NewRouter()
+		admin.register(adminRouter)
+	} else if s.c.AdminToken != "" {
+		admin.register(r)
+	}
+	// the endpoints of the server can be moved under an internal prefix so they do not shadow paths of the proxy target
+	internal := r
+	if s.c.InternalPrefix != "" {
+		internal = r.PathPrefix(s.c.InternalPrefix).Subrouter()
+	}
+	health := &healthHandlers{cache: s.cache, upstream: s.upstream}
+	health.register(internal)
+	if adminRouter != nil {
+		health.register(adminRouter)
+	}
+	if s.c.Metrics {
+		if adminRouter != nil {
+			adminRouter.Handle("/metrics", s.metrics.Handler()).Methods("GET")
+		} else {
+			internal.Handle("/metrics", s.metrics.Handler()).Methods("GET")
+		}
+	}
+
+	r.PathPrefix("/").HandlerFunc(instrument(h.CacheHandler, s.metrics.observe, s.accessLog.observe)).Methods("GET")
+	r.PathPrefix("/").HandlerFunc(instrument(h.ProxyHandler, s.metrics.observe, s.accessLog.observe))
+
+	return r, adminRouter
+}
+
+// newHTTPServer returns a http server with the timeouts of the config
+func (s *Server) newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: s.c.ReadHeaderTimeout,
+		IdleTimeout:       s.c.IdleTimeout,
+		WriteTimeout:      s.c.WriteTimeout,
+	}
+}
+
+// shutdown stops the servers once the requests in progress are served and closes the cache
+// Requests and downloads that are not finished within the shutdown timeout are aborted
+func (s *Server) shutdown(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.c.ShutdownTimeout)
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				log.Warnf("Aborting requests in progress on %s: %s", getAddrString(srv.Addr), err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	err := s.cache.Close(ctx)
+	if err != nil {
+		log.Errorf("Failed to close cache: %s", err)
+	}
+	s.accessLog.closeLog()
+	log.Info("Shut down")
 }
 
 // listenAndServe serves a plain http webserver
-func listenAndServe(ctx context.Context, cancel func(), addr string, handler http.Handler) {
+func listenAndServe(cancel func(), srv *http.Server) {
 	defer cancel()
-	addrStr := getAddrString(addr)
+	addrStr := getAddrString(srv.Addr)
 	log.Infof("http server listening on: http://%s\n", addrStr)
-	log.Error(http.ListenAndServe(addr, handler))
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Error(err)
+	}
 }
 
 // listenAndServeTLS serves a tls webserver
-func listenAndServeTLS(ctx context.Context, cancel func(), addr string, tls *TLSConfig, handler http.Handler) {
+func listenAndServeTLS(cancel func(), srv *http.Server, tls *TLSConfig) {
 	defer cancel()
-	addrStr := getAddrString(addr)
+	addrStr := getAddrString(srv.Addr)
 	log.Infof("https server listening on: http://%s\n", addrStr)
-	log.Error(http.ListenAndServeTLS(addr, tls.CertFile, tls.KeyFile, handler))
-}
-
-func testTarget(url string) error {
-	_, err := http.Get(url)
-	return err
+	err := srv.ListenAndServeTLS(tls.CertFile, tls.KeyFile)
+	if err != http.ErrServerClosed {
+		log.Error(err)
+	}
 }
 
 func getAddrString(addr string) string {
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInternalEndpoints(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("upstream " + req.URL.Path))
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		name      string
+		prefix    string
+		adminAddr string
+		path      string
+		admin     bool
+		status    int
+		body      string
+	}{
+		{name: "healthz", path: "/healthz", status: http.StatusOK, body: `"status":"ok"`},
+		{name: "readyz", path: "/readyz", body: `"checks"`},
+		{name: "metrics", path: "/metrics", status: http.StatusOK, body: "cacheserver_entries"},
+		{name: "upstream", path: "/foo", status: http.StatusOK, body: "upstream /foo"},
+		{name: "prefix upstream healthz", prefix: "/_cacheserver", path: "/healthz", status: http.StatusOK, body: "upstream /healthz"},
+		{name: "prefix upstream metrics", prefix: "/_cacheserver", path: "/metrics", status: http.StatusOK, body: "upstream /metrics"},
+		{name: "prefix healthz", prefix: "/_cacheserver", path: "/_cacheserver/healthz", status: http.StatusOK, body: `"status":"ok"`},
+		{name: "prefix metrics", prefix: "/_cacheserver", path: "/_cacheserver/metrics", status: http.StatusOK, body: "cacheserver_entries"},
+		{name: "admin healthz", adminAddr: "localhost:0", path: "/healthz", admin: true, status: http.StatusOK, body: `"status":"ok"`},
+		{name: "admin metrics", adminAddr: "localhost:0", path: "/metrics", admin: true, status: http.StatusOK, body: "cacheserver_entries"},
+		{name: "admin prefix metrics", prefix: "/_cacheserver", adminAddr: "localhost:0", path: "/metrics", admin: true, status: http.StatusOK, body: "cacheserver_entries"},
+		{name: "metrics on admin listener", adminAddr: "localhost:0", path: "/metrics", status: http.StatusOK, body: "upstream /metrics"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			dir, err := ioutil.TempDir("", "cacheserver")
+			assert.NoError(err)
+			defer os.RemoveAll(dir)
+			c := DefaultConfig()
+			c.ProxyTarget = target.URL
+			c.BackendFile = filepath.Join(dir, "backend.data")
+			c.CacheDir = filepath.Join(dir, "cache")
+			c.Metrics = true
+			c.InternalPrefix = test.prefix
+			c.AdminListenAddr = test.adminAddr
+			c.AdminToken = "secret"
+			assert.NoError(c.Validate())
+			s, err := New(c)
+			assert.NoError(err)
+			defer s.cache.Close(context.Background())
+
+			r, adminRouter := s.routers()
+			if test.admin {
+				r = adminRouter
+			}
+			res := httptest.NewRecorder()
+			r.ServeHTTP(res, httptest.NewRequest("GET", test.path, nil))
+			if test.status != 0 {
+				assert.Equal(test.status, res.Code)
+			}
+			assert.Contains(res.Body.String(), test.body)
+		})
+	}
+}
+
+func TestInternalPrefixValidation(t *testing.T) {
+	assert := assert.New(t)
+	c := DefaultConfig()
+	c.ProxyTarget = "http://localhost"
+	for _, prefix := range []string{"/", "_cacheserver", "/_cacheserver/"} {
+		c.InternalPrefix = prefix
+		assert.Error(c.Validate(), prefix)
+	}
+	for _, prefix := range []string{"", "/-/internal"} {
+		c.InternalPrefix = prefix
+		assert.NoError(c.Validate(), prefix)
+	}
+}
+
+func TestNewHTTPServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name              string
+		readHeaderTimeout time.Duration
+		idleTimeout       time.Duration
+		writeTimeout      time.Duration
+	}{
+		{name: "defaults", readHeaderTimeout: DefaultConfig().ReadHeaderTimeout, idleTimeout: DefaultConfig().IdleTimeout},
+		{name: "all", readHeaderTimeout: time.Second, idleTimeout: time.Minute, writeTimeout: time.Hour},
+		{name: "disabled"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			c := DefaultConfig()
+			c.ReadHeaderTimeout = test.readHeaderTimeout
+			c.IdleTimeout = test.idleTimeout
+			c.WriteTimeout = test.writeTimeout
+			s := &Server{c: c}
+			handler := http.NotFoundHandler()
+			srv := s.newHTTPServer(":1234", handler)
+			assert.Equal(":1234", srv.Addr)
+			assert.Equal(test.readHeaderTimeout, srv.ReadHeaderTimeout)
+			assert.Equal(test.idleTimeout, srv.IdleTimeout)
+			assert.Equal(test.writeTimeout, srv.WriteTimeout)
+			// the read timeout would cut off slow uploads
+			assert.Zero(srv.ReadTimeout)
+		})
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	assert := assert.New(t)
+	c := DefaultConfig()
+	c.ReadHeaderTimeout = 50 * time.Millisecond
+	s := &Server{c: c}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	srv := s.newHTTPServer(l.Addr().String(), http.NotFoundHandler())
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// a client that does not finish its headers is disconnected
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	assert.NoError(err)
+	assert.NoError(conn.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	start := time.Now()
+	_, err = ioutil.ReadAll(conn)
+	assert.NoError(err)
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	assert := assert.New(t)
+	c := DefaultConfig()
+	c.WriteTimeout = 50 * time.Millisecond
+	s := &Server{c: c}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	srv := s.newHTTPServer(l.Addr().String(), http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		res.Write([]byte("late"))
+	}))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// a response that is not written in time is cut off
+	_, err = http.Get("http://" + l.Addr().String())
+	assert.Error(err)
+}
+
+func TestDefaultDiskWatermarks(t *testing.T) {
+	assert := assert.New(t)
+	target := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write(make([]byte, 950))
+	}))
+	defer target.Close()
+	dir, err := ioutil.TempDir("", "cacheserver")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	c := DefaultConfig()
+	c.ProxyTarget = target.URL
+	c.BackendFile = filepath.Join(dir, "backend.data")
+	c.CacheVolumes = Volumes{{Dir: filepath.Join(dir, "cache"), Capacity: 1000}}
+	assert.NoError(c.Validate())
+
+	// the download fills 95% of the volume, which is over the default high watermark
+	// and is evicted when the disk is checked on the next start
+	for _, xCache := range []string{"MISS", "MISS"} {
+		s, err := New(c)
+		assert.NoError(err)
+		r, _ := s.routers()
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, httptest.NewRequest("GET", "/file", nil))
+		assert.Equal(http.StatusOK, res.Code)
+		assert.Equal(xCache, res.Header().Get("X-Cache"))
+		assert.NoError(s.cache.Close(context.Background()))
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals represents the signals that reopen the access log
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
+
+// shutdownSignals represents the signals that shut the server down gracefully
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+// reloadSignals represents the signals that reload the config
+var reloadSignals = []os.Signal{syscall.SIGHUP}
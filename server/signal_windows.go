@@ -0,0 +1,16 @@
+package server
+
+import (
+	"os"
+)
+
+// reopenSignals represents the signals that reopen the access log
+// Windows has no signal to reopen the access log with
+var reopenSignals []os.Signal
+
+// shutdownSignals represents the signals that shut the server down gracefully
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// reloadSignals represents the signals that reload the config
+// Windows has no signal to reload the config with
+var reloadSignals []os.Signal